@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+	"github.com/micvbang/simple-message-broker/internal/storage"
+)
+
+// smb-bench writes record batches to and reads them back from a backing
+// storage, and reports throughput and latency. It is meant for validating
+// infrastructure, e.g. EBS vs instance store vs S3, before production use.
+//
+// Each writer writes to its own topic, such that writers don't wait for each
+// other. Records are read back from the same topics, one reader per topic.
+// S3 reads bypass the local cache, but disk reads may be served from the
+// operating system's page cache.
+func main() {
+	flags := parseFlags()
+
+	ctx := context.Background()
+	log := logger.NewWithLevel(ctx, logger.LevelWarn)
+
+	openStorage, cleanup, err := makeOpenStorage(log, flags)
+	if err != nil {
+		log.Fatalf("failed to set up %s storage: %s", flags.backend, err)
+	}
+	defer cleanup()
+
+	topicPrefix := fmt.Sprintf("smb-bench-%d", time.Now().UnixMicro())
+	topics := make([]string, flags.concurrency)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("%s-%d", topicPrefix, i)
+	}
+
+	fmt.Printf("Benchmarking %s storage: %d writers, %d batches of %d records of %d bytes each\n",
+		flags.backend, flags.concurrency, flags.numBatches, flags.batchSize, flags.recordSize)
+
+	// records are generated up front, such that generating them isn't
+	// measured
+	records := make([][]byte, flags.batchSize)
+	for i := range records {
+		records[i] = make([]byte, flags.recordSize)
+		rand.Read(records[i])
+	}
+
+	writes, err := benchmark(topics, flags, func(topic string) (*storage.Storage, error) {
+		return openStorage(topic, false)
+	}, func(s *storage.Storage, batch int) error {
+		_, err := s.AddRecordBatch(records)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("failed to write: %s", err)
+	}
+	writes.print("write", flags)
+
+	reads, err := benchmark(topics, flags, func(topic string) (*storage.Storage, error) {
+		return openStorage(topic, true)
+	}, func(s *storage.Storage, batch int) error {
+		records, err := s.ReadRecords(uint64(batch*flags.batchSize), flags.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) != flags.batchSize {
+			return fmt.Errorf("read %d of %d records of batch %d", len(records), flags.batchSize, batch)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to read: %s", err)
+	}
+	reads.print("read", flags)
+}
+
+// openStorageFunc opens the Storage of topic. If cold is true, local caches
+// are bypassed such that record batches are read from the backing storage.
+type openStorageFunc func(topic string, cold bool) (*storage.Storage, error)
+
+// makeOpenStorage returns an openStorageFunc for the configured backend, and
+// a function that removes local files created by the benchmark.
+func makeOpenStorage(log logger.Logger, flags flags) (openStorageFunc, func(), error) {
+	switch flags.backend {
+	case "disk":
+		rootDir := flags.path
+		cleanup := func() {}
+		if rootDir == "" {
+			tempDir, err := os.MkdirTemp("", "smb-bench_*")
+			if err != nil {
+				return nil, nil, err
+			}
+			rootDir = tempDir
+			cleanup = func() { os.RemoveAll(tempDir) }
+		}
+
+		return func(topic string, cold bool) (*storage.Storage, error) {
+			return storage.NewDiskStorage(log, rootDir, topic)
+		}, cleanup, nil
+
+	case "s3":
+		if flags.s3Bucket == "" {
+			return nil, nil, fmt.Errorf("-s3-bucket is required")
+		}
+
+		config := aws.NewConfig()
+		if flags.s3Region != "" {
+			config = config.WithRegion(flags.s3Region)
+		}
+		if flags.s3Endpoint != "" {
+			config = config.WithEndpoint(flags.s3Endpoint).WithS3ForcePathStyle(true)
+		}
+		sess, err := session.NewSession(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		s3Client := s3.New(sess)
+
+		cacheDir := flags.path
+		removeDirs := []string{filepath.Join(cacheDir, "write"), filepath.Join(cacheDir, "read")}
+		if cacheDir == "" {
+			cacheDir, err = os.MkdirTemp("", "smb-bench_*")
+			if err != nil {
+				return nil, nil, err
+			}
+			removeDirs = []string{cacheDir}
+		}
+		cleanup := func() {
+			for _, dir := range removeDirs {
+				os.RemoveAll(dir)
+			}
+			fmt.Printf("Record batches were written to s3://%s/%s\n", flags.s3Bucket, flags.s3RootDir)
+		}
+
+		return func(topic string, cold bool) (*storage.Storage, error) {
+			// reads use a separate cache, such that record batches are
+			// downloaded from S3
+			cacheRoot := filepath.Join(cacheDir, "write")
+			if cold {
+				cacheRoot = filepath.Join(cacheDir, "read")
+			}
+
+			return storage.NewS3Storage(log, storage.S3StorageInput{
+				S3:             s3Client,
+				LocalCacheRoot: cacheRoot,
+				BucketName:     flags.s3Bucket,
+				RootDir:        flags.s3RootDir,
+				Topic:          topic,
+			})
+		}, cleanup, nil
+
+	case "null":
+		nullStorage := &storage.NullStorage{}
+		return func(topic string, cold bool) (*storage.Storage, error) {
+			return storage.NewStorage(log, nullStorage, "", topic)
+		}, func() {}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown backend '%s', must be one of disk, s3 or null", flags.backend)
+}
+
+// results holds the latencies of each operation of a benchmark, and its
+// total duration.
+type results struct {
+	latencies []time.Duration
+	elapsed   time.Duration
+}
+
+// benchmark calls op for each of flags.numBatches batches of each topic,
+// concurrently for all topics.
+func benchmark(topics []string, flags flags, openStorage func(topic string) (*storage.Storage, error), op func(s *storage.Storage, batch int) error) (results, error) {
+	storages := make([]*storage.Storage, len(topics))
+	for i, topic := range topics {
+		s, err := openStorage(topic)
+		if err != nil {
+			return results{}, fmt.Errorf("opening topic '%s': %w", topic, err)
+		}
+		storages[i] = s
+	}
+
+	mu := sync.Mutex{}
+	latencies := make([]time.Duration, 0, len(topics)*flags.numBatches)
+	errs := make([]error, len(topics))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(storages))
+	t0 := time.Now()
+	for i, s := range storages {
+		i, s := i, s
+		go func() {
+			defer wg.Done()
+
+			topicLatencies := make([]time.Duration, 0, flags.numBatches)
+			for batch := 0; batch < flags.numBatches; batch++ {
+				start := time.Now()
+				err := op(s, batch)
+				if err != nil {
+					errs[i] = fmt.Errorf("topic '%s', batch %d: %w", topics[i], batch, err)
+					return
+				}
+				topicLatencies = append(topicLatencies, time.Since(start))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, topicLatencies...)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(t0)
+
+	for _, err := range errs {
+		if err != nil {
+			return results{}, err
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	return results{latencies: latencies, elapsed: elapsed}, nil
+}
+
+func (r results) print(name string, flags flags) {
+	batches := len(r.latencies)
+	records := batches * flags.batchSize
+	megabytes := float64(records*flags.recordSize) / (1024 * 1024)
+	seconds := r.elapsed.Seconds()
+
+	fmt.Printf("%s: %d batches in %s: %.0f batches/s, %.0f records/s, %.2f MiB/s\n",
+		name, batches, r.elapsed.Round(time.Millisecond), float64(batches)/seconds, float64(records)/seconds, megabytes/seconds)
+	fmt.Printf("%s latency per batch: p50 %s, p90 %s, p99 %s, max %s\n",
+		name, r.percentile(50), r.percentile(90), r.percentile(99), r.percentile(100))
+}
+
+// percentile returns the p'th percentile latency; latencies must be sorted.
+func (r results) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	i := (len(r.latencies)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return r.latencies[i].Round(time.Microsecond)
+}
+
+type flags struct {
+	backend     string
+	path        string
+	batchSize   int
+	recordSize  int
+	numBatches  int
+	concurrency int
+
+	s3Bucket   string
+	s3RootDir  string
+	s3Region   string
+	s3Endpoint string
+}
+
+func parseFlags() flags {
+	fs := flag.NewFlagSet("smb-bench", flag.ExitOnError)
+
+	f := flags{}
+
+	fs.StringVar(&f.backend, "backend", "disk", "Backing storage to benchmark: disk, s3 or null")
+	fs.StringVar(&f.path, "path", "", "Root directory for disk, or local cache directory for s3. A temporary directory is used if empty")
+	fs.IntVar(&f.batchSize, "batch-size", 100, "Number of records per record batch")
+	fs.IntVar(&f.recordSize, "record-size", 1024, "Size of each record in bytes")
+	fs.IntVar(&f.numBatches, "batches", 100, "Number of record batches written and read by each writer")
+	fs.IntVar(&f.concurrency, "concurrency", 1, "Number of concurrent writers and readers, each using its own topic")
+
+	fs.StringVar(&f.s3Bucket, "s3-bucket", "", "S3 bucket to write record batches to")
+	fs.StringVar(&f.s3RootDir, "s3-root", "smb-bench", "S3 key prefix to write record batches under")
+	fs.StringVar(&f.s3Region, "s3-region", "", "S3 region, defaults to the AWS SDK's configuration")
+	fs.StringVar(&f.s3Endpoint, "s3-endpoint", "", "S3 endpoint, e.g. of an S3 compatible service")
+
+	err := fs.Parse(os.Args[1:])
+	if err != nil {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if f.batchSize <= 0 || f.recordSize < 0 || f.numBatches <= 0 || f.concurrency <= 0 {
+		fmt.Fprintf(os.Stderr, "-batch-size, -batches and -concurrency must be positive, and -record-size must not be negative\n")
+		os.Exit(1)
+	}
+
+	return f
+}
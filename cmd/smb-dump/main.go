@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -32,18 +31,21 @@ func main() {
 		log.Fatalf("failed to initialized disk storage: %s", err)
 	}
 
-	for i := flags.startFromRecordID; i < flags.startFromRecordID+flags.numRecords; i++ {
-		record, err := diskStorage.ReadRecord(uint64(i))
-		if err != nil {
-			if errors.Is(err, storage.ErrOutOfBounds) {
-				fmt.Printf("out of bounds\n")
+	it := diskStorage.Iterator(uint64(flags.startFromRecordID))
+	defer it.Close()
+
+	for i := 0; i < flags.numRecords; i++ {
+		if !it.Next() {
+			if it.Err() != nil {
+				fmt.Printf("ERROR: reading record %d: %s\n", flags.startFromRecordID+i, it.Err())
 				return
 			}
 
-			fmt.Printf("ERROR: reading record %d: %s\n", i, err)
+			fmt.Printf("out of bounds\n")
+			return
 		}
 
-		fmt.Printf("record %d: %s\n", i, record)
+		fmt.Printf("record %d: %s\n", it.RecordID(), it.Record())
 	}
 }
 
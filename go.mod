@@ -3,13 +3,16 @@ module github.com/micvbang/simple-message-broker
 go 1.18
 
 require (
-	github.com/aws/aws-sdk-go v1.49.8 // indirect
+	github.com/aws/aws-sdk-go v1.49.8
+	github.com/micvbang/go-helpy v0.1.11
+	github.com/sirupsen/logrus v1.9.3
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/micvbang/go-helpy v0.1.11 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,29 +2,69 @@ package recordbatch
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
 )
 
+var (
+	// ErrPersistPanic is returned to callers of Add() when
+	// persistRecordBatch() panics.
+	ErrPersistPanic = fmt.Errorf("panic while persisting record batch")
+
+	// ErrBatcherClosed is returned to callers of Add() after Close() has been
+	// called.
+	ErrBatcherClosed = fmt.Errorf("batcher closed")
+
+	// ErrBatcherFull is returned to callers of Add() when adding the records
+	// would exceed MaxPendingBytes. Callers should back off and retry, e.g. by
+	// responding with 503 Service Unavailable and a Retry-After header.
+	ErrBatcherFull = fmt.Errorf("batcher full")
+)
+
 type blockedAdd struct {
-	record []byte
-	err    chan<- error
+	records  [][]byte
+	response chan<- addResponse
+}
+
+type addResponse struct {
+	recordIDs []uint64
+	err       error
 }
 
 type BlockingBatcher struct {
+	// MaxPendingBytes limits the total size of records that Add()ers may be
+	// blocked on. When the limit would be exceeded, Add() returns
+	// ErrBatcherFull instead of blocking. A single Add() is always accepted
+	// when nothing is pending, regardless of its size. Zero means no limit.
+	// Must be set before calling Add().
+	MaxPendingBytes int
+
 	log             logger.Logger
 	mu              sync.Mutex
 	collectingBatch bool
+	flushBatch      chan struct{}
+	stats           BatcherStats
+	closed          bool
+
+	// inflightBytes is the total size of records whose Add()ers are blocked
+	inflightBytes int
+
+	// sendingAdds is the number of Add()ers that are about to send to
+	// blockedAdds.
+	sendingAdds int
+	collectors  sync.WaitGroup
 
 	makeContext func() context.Context
 	blockedAdds chan blockedAdd
 
-	persistRecordBatch func([][]byte) error
+	persistRecordBatch func([][]byte) ([]uint64, error)
 }
 
-func NewBlockingBatcher(log logger.Logger, makeContext func() context.Context, persistRecordBatch func([][]byte) error) *BlockingBatcher {
+func NewBlockingBatcher(log logger.Logger, makeContext func() context.Context, persistRecordBatch func([][]byte) ([]uint64, error)) *BlockingBatcher {
 	return &BlockingBatcher{
 		log:                log,
 		mu:                 sync.Mutex{},
@@ -35,33 +75,98 @@ func NewBlockingBatcher(log logger.Logger, makeContext func() context.Context, p
 }
 
 // Add adds record to the ongoing record batch and blocks until
-// persistRecordBatch() has been called and completed.
+// persistRecordBatch() has been called and completed. The record ID assigned
+// to record by persistRecordBatch() is returned.
 //
 // persistRecordBatch() will be called once the most recent context
 // returned by makeContext() has expired. This means that, if makeContext()
 // returns a very long living context, Add() will block for a long time.
-func (b *BlockingBatcher) Add(record []byte) error {
-	errCh := make(chan error)
+func (b *BlockingBatcher) Add(record []byte) (uint64, error) {
+	recordIDs, err := b.AddRecords([][]byte{record})
+	if err != nil {
+		return 0, err
+	}
+
+	return recordIDs[0], nil
+}
+
+// AddRecords adds records to the ongoing record batch and blocks until
+// persistRecordBatch() has been called and completed, see Add(). All of the
+// given records are added to the same record batch, in the given order, and
+// the record IDs assigned to them are returned.
+func (b *BlockingBatcher) AddRecords(records [][]byte) ([]uint64, error) {
+	if len(records) == 0 {
+		return []uint64{}, nil
+	}
+
+	responseCh := make(chan addResponse)
+
+	recordsBytes := 0
+	for _, record := range records {
+		recordsBytes += len(record)
+	}
 
 	b.mu.Lock()
 	{
+		if b.closed {
+			b.mu.Unlock()
+			return nil, ErrBatcherClosed
+		}
+
+		if b.MaxPendingBytes > 0 && b.inflightBytes > 0 && b.inflightBytes+recordsBytes > b.MaxPendingBytes {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("%d bytes pending: %w", b.inflightBytes, ErrBatcherFull)
+		}
+		b.inflightBytes += recordsBytes
+
 		if !b.collectingBatch {
-			b.collectingBatch = true
-			go b.collectBatch(b.makeContext())
+			b.startCollecting()
 		}
+		b.sendingAdds += 1
 	}
 	b.mu.Unlock()
 
 	b.blockedAdds <- blockedAdd{
-		err:    errCh,
-		record: record,
+		response: responseCh,
+		records:  records,
 	}
 
-	// block until record has been peristed
-	return <-errCh
+	b.mu.Lock()
+	{
+		b.sendingAdds -= 1
+	}
+	b.mu.Unlock()
+
+	// block until records have been peristed
+	response := <-responseCh
+
+	b.mu.Lock()
+	{
+		b.inflightBytes -= recordsBytes
+	}
+	b.mu.Unlock()
+
+	return response.recordIDs, response.err
+}
+
+// startCollecting starts collecting a new batch. b.mu must be held.
+func (b *BlockingBatcher) startCollecting() {
+	flush := make(chan struct{})
+	b.flushBatch = flush
+	if b.closed {
+		// persist immediately
+		close(flush)
+		b.flushBatch = nil
+	}
+
+	b.collectingBatch = true
+	b.collectors.Add(1)
+	go b.collectBatch(b.makeContext(), flush)
 }
 
-func (b *BlockingBatcher) collectBatch(ctx context.Context) {
+func (b *BlockingBatcher) collectBatch(ctx context.Context, flush <-chan struct{}) {
+	defer b.collectors.Done()
+
 	handledAdds := make([]blockedAdd, 0, 64)
 
 	t0 := time.Now()
@@ -71,39 +176,161 @@ func (b *BlockingBatcher) collectBatch(ctx context.Context) {
 
 		case blockedAdd := <-b.blockedAdds:
 			handledAdds = append(handledAdds, blockedAdd)
-			b.log.Debugf("added record to batch (%d)", len(handledAdds))
+			b.log.Debugf("added %d records to batch (%d)", len(blockedAdd.records), len(handledAdds))
+
+			b.mu.Lock()
+			{
+				if b.stats.PendingRecords == 0 {
+					b.stats.OldestPending = time.Now()
+				}
+				b.stats.PendingRecords += len(blockedAdd.records)
+				for _, record := range blockedAdd.records {
+					b.stats.PendingBytes += len(record)
+				}
+			}
+			b.mu.Unlock()
+
+		case <-flush:
+			b.log.Debugf("flush requested")
+			b.persistBatch(handledAdds, t0)
+			return
 
 		case <-ctx.Done():
-			b.log.Debugf("batch collection time: %v", time.Since(t0))
+			b.persistBatch(handledAdds, t0)
+			return
+		}
+	}
+}
 
-			recordBatch := make([][]byte, len(handledAdds))
-			for i, add := range handledAdds {
-				recordBatch[i] = add.record
-			}
+func (b *BlockingBatcher) persistBatch(handledAdds []blockedAdd, t0 time.Time) {
+	b.log.Debugf("batch collection time: %v", time.Since(t0))
 
-			err := b.persistRecordBatch(recordBatch)
-			b.log.Debugf("%d records persisted (err: %v)", len(recordBatch), err)
-			if err != nil {
-				b.log.Debugf("reporting error to %d waiting add()ers", len(recordBatch))
-				for _, handledAdd := range handledAdds {
-					handledAdd.err <- err
-				}
-			}
+	if len(handledAdds) == 0 {
+		b.finishBatch()
+		return
+	}
 
-			// Unblock Add()ers
-			for _, handledAdd := range handledAdds {
-				close(handledAdd.err)
-			}
+	recordBatch := make([][]byte, 0, len(handledAdds))
+	for _, add := range handledAdds {
+		recordBatch = append(recordBatch, add.records...)
+	}
 
-			b.log.Debugf("done reporting results")
+	recordIDs, err := b.persist(recordBatch)
+	b.log.Debugf("%d records persisted (err: %v)", len(recordBatch), err)
+	if err == nil && len(recordIDs) != len(recordBatch) {
+		err = fmt.Errorf("expected %d record IDs, got %d", len(recordBatch), len(recordIDs))
+	}
 
-			b.mu.Lock()
-			{
-				b.collectingBatch = false
-			}
-			b.mu.Unlock()
+	if err != nil {
+		b.log.Debugf("reporting error to %d waiting add()ers", len(handledAdds))
+	}
 
-			return
+	// Unblock Add()ers
+	offset := 0
+	for _, handledAdd := range handledAdds {
+		response := addResponse{err: err}
+		if err == nil {
+			response.recordIDs = recordIDs[offset : offset+len(handledAdd.records)]
+		}
+		offset += len(handledAdd.records)
+		handledAdd.response <- response
+		close(handledAdd.response)
+	}
+
+	b.log.Debugf("done reporting results")
+
+	b.mu.Lock()
+	{
+		b.stats.PendingRecords = 0
+		b.stats.PendingBytes = 0
+		b.stats.OldestPending = time.Time{}
+		b.stats.LastFlush = time.Now()
+		b.stats.LastFlushErr = err
+	}
+	b.mu.Unlock()
+
+	b.finishBatch()
+}
+
+// finishBatch stops collecting the current batch. If any Add()ers raced with
+// the end of the batch, collection of a new batch is started.
+func (b *BlockingBatcher) finishBatch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sendingAdds > 0 || len(b.blockedAdds) > 0 {
+		b.startCollecting()
+		return
+	}
+
+	b.collectingBatch = false
+	b.flushBatch = nil
+}
+
+// Close stops the batcher from accepting new records and persists the ongoing
+// record batch immediately, blocking until it has been persisted. Calls to
+// Add() after Close() return ErrBatcherClosed.
+func (b *BlockingBatcher) Close() {
+	b.mu.Lock()
+	{
+		b.closed = true
+		if b.flushBatch != nil {
+			close(b.flushBatch)
+			b.flushBatch = nil
 		}
 	}
+	b.mu.Unlock()
+
+	b.collectors.Wait()
+}
+
+// Flush makes the ongoing record batch, if any, be persisted immediately
+// instead of waiting for the context returned by makeContext() to expire.
+func (b *BlockingBatcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.flushBatch != nil {
+		close(b.flushBatch)
+		b.flushBatch = nil
+	}
+}
+
+// BatcherStats describes the state of a BlockingBatcher.
+type BatcherStats struct {
+	// PendingRecords is the number of records in the ongoing record batch.
+	PendingRecords int
+	// PendingBytes is the total size of the records in the ongoing record
+	// batch.
+	PendingBytes int
+	// OldestPending is the time the oldest record in the ongoing record batch
+	// was added. It is the zero value if there are no pending records.
+	OldestPending time.Time
+	// LastFlush is the time the most recent record batch was persisted.
+	LastFlush time.Time
+	// LastFlushErr is the error returned when persisting the most recent
+	// record batch.
+	LastFlushErr error
+}
+
+// Stats returns a snapshot of the batcher's current state.
+func (b *BlockingBatcher) Stats() BatcherStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stats
+}
+
+// persist calls persistRecordBatch() and recovers from any panic it causes,
+// such that callers of Add() are unblocked and future batches can still be
+// collected.
+func (b *BlockingBatcher) persist(recordBatch [][]byte) (recordIDs []uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.log.Errorf("recovered from panic while persisting %d records: %v\n%s", len(recordBatch), r, debug.Stack())
+			err = fmt.Errorf("%w: %v", ErrPersistPanic, r)
+		}
+	}()
+
+	return b.persistRecordBatch(recordBatch)
 }
@@ -30,8 +30,8 @@ func TestBlockingBatcherAddReturnValue(t *testing.T) {
 		return ctx
 	}
 
-	persistRecordBatch := func(recordBatch [][]byte) error {
-		return returnedErr
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		return make([]uint64, len(recordBatch)), returnedErr
 	}
 
 	tests := map[string]struct {
@@ -53,7 +53,7 @@ func TestBlockingBatcherAddReturnValue(t *testing.T) {
 			returnedErr = test.expected
 
 			// Test
-			got := batcher.Add([]byte{})
+			_, got := batcher.Add([]byte{})
 
 			// Verify
 			require.ErrorIs(t, got, test.expected)
@@ -73,9 +73,9 @@ func TestBlockingBatcherAddBlocks(t *testing.T) {
 
 	blockPersistRecordBatch := make(chan struct{})
 	returnedErr := fmt.Errorf("all is on fire!")
-	persistRecordBatch := func(recordBatch [][]byte) error {
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
 		<-blockPersistRecordBatch
-		return returnedErr
+		return nil, returnedErr
 	}
 
 	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
@@ -93,7 +93,7 @@ func TestBlockingBatcherAddBlocks(t *testing.T) {
 			defer wg.Done()
 
 			// Test
-			got := batcher.Add(recordBatch)
+			_, got := batcher.Add(recordBatch)
 			addReturned.Store(true)
 
 			// Verify
@@ -122,3 +122,314 @@ func TestBlockingBatcherAddBlocks(t *testing.T) {
 	// ensure that all Add()ers return
 	wg.Wait()
 }
+
+// TestBlockingBatcherAddReturnsRecordID verifies that the record IDs returned
+// by persistRecordBatch() are returned to the callers of Add() that added the
+// corresponding records.
+func TestBlockingBatcherAddReturnsRecordID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	makeContext := func() context.Context {
+		return ctx
+	}
+
+	const firstRecordID = 42
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		recordIDs := make([]uint64, len(recordBatch))
+		for i, record := range recordBatch {
+			// records contain the offset of their expected record ID
+			recordIDs[i] = firstRecordID + uint64(record[0])
+		}
+		return recordIDs, nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	const numRecords = 10
+
+	wg := sync.WaitGroup{}
+	wg.Add(numRecords)
+
+	for i := 0; i < numRecords; i++ {
+		i := i
+
+		go func() {
+			defer wg.Done()
+
+			// Test
+			got, err := batcher.Add([]byte{byte(i)})
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, uint64(firstRecordID+i), got)
+		}()
+	}
+
+	// wait for all above go-routines to be scheduled and block on Add()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	wg.Wait()
+}
+
+// TestBlockingBatcherAddRecordIDsMismatch verifies that an error is returned
+// to callers of Add() when persistRecordBatch() doesn't return a record ID
+// per record.
+func TestBlockingBatcherAddRecordIDsMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	makeContext := func() context.Context {
+		return ctx
+	}
+
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		return nil, nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	// Test
+	_, err := batcher.Add([]byte("record"))
+
+	// Verify
+	require.Error(t, err)
+}
+
+// TestBlockingBatcherPersistPanic verifies that a panic in
+// persistRecordBatch() is returned as ErrPersistPanic to callers of Add(), and
+// that the batcher keeps working afterwards.
+func TestBlockingBatcherPersistPanic(t *testing.T) {
+	makeContext := func() context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return ctx
+	}
+
+	shouldPanic := true
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		if shouldPanic {
+			panic("oh no")
+		}
+		return make([]uint64, len(recordBatch)), nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	// Test
+	_, err := batcher.Add([]byte("record"))
+
+	// Verify
+	require.ErrorIs(t, err, recordbatch.ErrPersistPanic)
+
+	shouldPanic = false
+	_, err = batcher.Add([]byte("record"))
+	require.NoError(t, err)
+}
+
+// TestBlockingBatcherAddRecords verifies that all records given to AddRecords()
+// are added to the same record batch, consecutively and in order, and that
+// their record IDs are returned.
+func TestBlockingBatcherAddRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	makeContext := func() context.Context {
+		return ctx
+	}
+
+	var persistedBatch [][]byte
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		persistedBatch = recordBatch
+
+		recordIDs := make([]uint64, len(recordBatch))
+		for i := range recordBatch {
+			recordIDs[i] = uint64(i)
+		}
+		return recordIDs, nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	records1 := tester.MakeRandomRecordBatch(5)
+	records2 := tester.MakeRandomRecordBatch(3)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var recordIDs1 []uint64
+	go func() {
+		defer wg.Done()
+
+		var err error
+		recordIDs1, err = batcher.AddRecords(records1)
+		require.NoError(t, err)
+	}()
+
+	// wait for records1 to be added to the batch before records2
+	time.Sleep(10 * time.Millisecond)
+
+	wg.Add(1)
+	var recordIDs2 []uint64
+	go func() {
+		defer wg.Done()
+
+		var err error
+		recordIDs2, err = batcher.AddRecords(records2)
+		require.NoError(t, err)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Test
+	cancel()
+	wg.Wait()
+
+	// Verify
+	require.Equal(t, append(records1, records2...), persistedBatch)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, recordIDs1)
+	require.Equal(t, []uint64{5, 6, 7}, recordIDs2)
+}
+
+// TestBlockingBatcherFlushAndStats verifies that Stats() reports the pending
+// records of the ongoing batch, and that Flush() persists the ongoing batch
+// without waiting for its context to expire.
+func TestBlockingBatcherFlushAndStats(t *testing.T) {
+	makeContext := func() context.Context {
+		return context.Background()
+	}
+
+	persistErr := fmt.Errorf("persist failed")
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		return nil, persistErr
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	// Flush() is a no-op when no batch is being collected
+	batcher.Flush()
+
+	records := tester.MakeRandomRecordBatch(3)
+	expectedBytes := 0
+	for _, record := range records {
+		expectedBytes += len(record)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := batcher.AddRecords(records)
+		require.ErrorIs(t, err, persistErr)
+	}()
+
+	// wait for records to be added to the batch
+	time.Sleep(10 * time.Millisecond)
+
+	stats := batcher.Stats()
+	require.Equal(t, len(records), stats.PendingRecords)
+	require.Equal(t, expectedBytes, stats.PendingBytes)
+	require.False(t, stats.OldestPending.IsZero())
+	require.True(t, stats.LastFlush.IsZero())
+
+	// Test
+	batcher.Flush()
+	wg.Wait()
+
+	// Verify
+	stats = batcher.Stats()
+	require.Equal(t, 0, stats.PendingRecords)
+	require.Equal(t, 0, stats.PendingBytes)
+	require.True(t, stats.OldestPending.IsZero())
+	require.False(t, stats.LastFlush.IsZero())
+	require.ErrorIs(t, stats.LastFlushErr, persistErr)
+}
+
+// TestBlockingBatcherClose verifies that Close() persists the ongoing batch
+// immediately, blocks until it has been persisted, and that Add() returns
+// ErrBatcherClosed afterwards.
+func TestBlockingBatcherClose(t *testing.T) {
+	makeContext := func() context.Context {
+		// never expires
+		return context.Background()
+	}
+
+	persisted := atomic.Int32{}
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		time.Sleep(10 * time.Millisecond)
+		persisted.Add(int32(len(recordBatch)))
+		return make([]uint64, len(recordBatch)), nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+
+	const numRecords = 10
+
+	wg := sync.WaitGroup{}
+	wg.Add(numRecords)
+	for i := 0; i < numRecords; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := batcher.Add([]byte("record"))
+			require.NoError(t, err)
+		}()
+	}
+
+	// wait for all above go-routines to be scheduled and block on Add()
+	time.Sleep(10 * time.Millisecond)
+
+	// Test
+	batcher.Close()
+
+	// Verify
+	require.Equal(t, int32(numRecords), persisted.Load())
+	wg.Wait()
+
+	_, err := batcher.Add([]byte("record"))
+	require.ErrorIs(t, err, recordbatch.ErrBatcherClosed)
+}
+
+// TestBlockingBatcherMaxPendingBytes verifies that Add() returns
+// ErrBatcherFull instead of blocking when MaxPendingBytes would be exceeded,
+// and that records are accepted again once pending records are persisted.
+func TestBlockingBatcherMaxPendingBytes(t *testing.T) {
+	makeContext := func() context.Context {
+		// never expires
+		return context.Background()
+	}
+
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		return make([]uint64, len(recordBatch)), nil
+	}
+
+	batcher := recordbatch.NewBlockingBatcher(log, makeContext, persistRecordBatch)
+	batcher.MaxPendingBytes = 10
+
+	// larger than MaxPendingBytes, but nothing else is pending
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := batcher.Add(make([]byte, 15))
+		require.NoError(t, err)
+	}()
+
+	// wait for record to be added to the batch
+	time.Sleep(10 * time.Millisecond)
+
+	// Test
+	_, err := batcher.Add([]byte("a"))
+
+	// Verify
+	require.ErrorIs(t, err, recordbatch.ErrBatcherFull)
+
+	batcher.Flush()
+	wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := batcher.Add([]byte("a"))
+		require.NoError(t, err)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	batcher.Flush()
+	wg.Wait()
+}
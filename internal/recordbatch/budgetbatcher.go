@@ -0,0 +1,87 @@
+package recordbatch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+)
+
+// BudgetBatcher groups records into separate batches depending on the latency
+// budget given by the producer. This ensures that records with a small latency
+// budget aren't held back by batches collecting records with a large one.
+type BudgetBatcher struct {
+	budgets  []time.Duration
+	batchers []*BlockingBatcher
+}
+
+// NewBudgetBatcher returns a BudgetBatcher with one batch class per given
+// budget. Each class collects records for the duration of its budget before
+// calling persistRecordBatch().
+//
+// NOTE: persistRecordBatch() may be called concurrently by different classes.
+func NewBudgetBatcher(log logger.Logger, budgets []time.Duration, persistRecordBatch func([][]byte) ([]uint64, error)) (*BudgetBatcher, error) {
+	if len(budgets) == 0 {
+		return nil, fmt.Errorf("at least one latency budget required")
+	}
+
+	budgets = append([]time.Duration{}, budgets...)
+	sort.Slice(budgets, func(i, j int) bool {
+		return budgets[i] < budgets[j]
+	})
+
+	batchers := make([]*BlockingBatcher, len(budgets))
+	for i, budget := range budgets {
+		budget := budget
+
+		makeContext := func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(budget, cancel)
+			return ctx
+		}
+
+		log := log.WithField("budget", budget)
+		batchers[i] = NewBlockingBatcher(log, makeContext, persistRecordBatch)
+	}
+
+	return &BudgetBatcher{
+		budgets:  budgets,
+		batchers: batchers,
+	}, nil
+}
+
+// Add adds record to the batch of the class with the largest budget that does
+// not exceed maxLatency. If maxLatency is smaller than all budgets, the class
+// with the smallest budget is used.
+//
+// Add blocks until the record has been persisted and returns its record ID, see
+// BlockingBatcher.Add().
+func (b *BudgetBatcher) Add(record []byte, maxLatency time.Duration) (uint64, error) {
+	return b.batchers[b.classIndex(maxLatency)].Add(record)
+}
+
+// AddRecords adds records to the same batch of the class chosen by maxLatency,
+// see Add() and BlockingBatcher.AddRecords().
+func (b *BudgetBatcher) AddRecords(records [][]byte, maxLatency time.Duration) ([]uint64, error) {
+	return b.batchers[b.classIndex(maxLatency)].AddRecords(records)
+}
+
+// Close closes the batchers of all classes, see BlockingBatcher.Close().
+func (b *BudgetBatcher) Close() {
+	for _, batcher := range b.batchers {
+		batcher.Close()
+	}
+}
+
+func (b *BudgetBatcher) classIndex(maxLatency time.Duration) int {
+	// index of first budget that is larger than maxLatency
+	i := sort.Search(len(b.budgets), func(i int) bool {
+		return b.budgets[i] > maxLatency
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
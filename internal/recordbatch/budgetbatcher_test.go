@@ -0,0 +1,91 @@
+package recordbatch_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBudgetBatcherLowLatencyNotBlocked verifies that records added with a
+// small latency budget are persisted without waiting for the batch of a class
+// with a larger budget.
+func TestBudgetBatcherLowLatencyNotBlocked(t *testing.T) {
+	const (
+		lowBudget  = 10 * time.Millisecond
+		bulkBudget = 500 * time.Millisecond
+	)
+
+	mu := sync.Mutex{}
+	persistedBatches := [][][]byte{}
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		persistedBatches = append(persistedBatches, recordBatch)
+		return make([]uint64, len(recordBatch)), nil
+	}
+
+	batcher, err := recordbatch.NewBudgetBatcher(log, []time.Duration{bulkBudget, lowBudget}, persistRecordBatch)
+	require.NoError(t, err)
+
+	bulkReturned := atomic.Bool{}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := batcher.Add([]byte("bulk"), time.Hour)
+		require.NoError(t, err)
+		bulkReturned.Store(true)
+	}()
+
+	// wait for bulk record to be added to its batch
+	time.Sleep(5 * time.Millisecond)
+
+	// Test
+	t0 := time.Now()
+	_, err = batcher.Add([]byte("low"), lowBudget)
+	require.NoError(t, err)
+
+	// Verify
+	require.Less(t, time.Since(t0), bulkBudget)
+	require.False(t, bulkReturned.Load())
+
+	wg.Wait()
+	require.True(t, bulkReturned.Load())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, [][][]byte{{[]byte("low")}, {[]byte("bulk")}}, persistedBatches)
+}
+
+// TestBudgetBatcherSmallerThanAllBudgets verifies that records with a latency
+// budget smaller than all configured budgets are added to the class with the
+// smallest budget.
+func TestBudgetBatcherSmallerThanAllBudgets(t *testing.T) {
+	const lowBudget = 10 * time.Millisecond
+
+	persistRecordBatch := func(recordBatch [][]byte) ([]uint64, error) {
+		return make([]uint64, len(recordBatch)), nil
+	}
+
+	batcher, err := recordbatch.NewBudgetBatcher(log, []time.Duration{lowBudget, time.Hour}, persistRecordBatch)
+	require.NoError(t, err)
+
+	// Test
+	t0 := time.Now()
+	_, err = batcher.Add([]byte("record"), time.Microsecond)
+
+	// Verify
+	require.NoError(t, err)
+	require.Less(t, time.Since(t0), time.Second)
+}
+
+// TestBudgetBatcherNoBudgets verifies that an error is returned when no
+// budgets are given.
+func TestBudgetBatcherNoBudgets(t *testing.T) {
+	_, err := recordbatch.NewBudgetBatcher(log, nil, func([][]byte) ([]uint64, error) { return nil, nil })
+	require.Error(t, err)
+}
@@ -13,9 +13,29 @@ var (
 )
 
 const (
-	FileFormatVersion = 1
-	headerBytes       = 32
+	FileFormatVersion = 2
 	recordIndexSize   = 4
+
+	// HeaderBytes is the size of the encoded Header.
+	HeaderBytes = 32
+
+	// Alignment is the boundary that the records section and the end of
+	// files written by WriteAligned() are aligned to.
+	Alignment = 4096
+)
+
+const (
+	// FlagAligned marks files whose records section starts at an offset that
+	// is a multiple of Alignment.
+	FlagAligned uint16 = 1 << iota
+
+	// FlagIndexFooter marks files written by Writer, whose record index
+	// follows the records section and is terminated by a footer holding the
+	// number of records and the size of the records section. NumRecords and
+	// RecordsSize of the header are zero for such files.
+	FlagIndexFooter
+
+	knownFlags = FlagAligned | FlagIndexFooter
 )
 
 type Header struct {
@@ -23,7 +43,15 @@ type Header struct {
 	Version     int16
 	UnixEpochUs int64
 	NumRecords  uint32
-	Reserved    [14]byte
+
+	// RecordsSize is the total size of all records in bytes. Introduced in
+	// version 2; for version 1 files, records are assumed to extend to the
+	// end of the file.
+	RecordsSize uint32
+
+	// Flags is a bit set of Flag* values. Introduced in version 2.
+	Flags    uint16
+	Reserved [8]byte
 }
 
 var UnixEpochUs = func() int64 {
@@ -33,11 +61,33 @@ var UnixEpochUs = func() int64 {
 // Write writes a RecordBatch file to wtr, consisting of a header, a record
 // index, and the given records.
 func Write(wtr io.Writer, records [][]byte) error {
+	return write(wtr, records, 0)
+}
+
+// WriteAligned writes a RecordBatch file to wtr like Write(), but pads the
+// record index such that the records section starts at a multiple of
+// Alignment, and pads the end of the file to a multiple of Alignment. This
+// allows reading records using direct I/O or mmap.
+func WriteAligned(wtr io.Writer, records [][]byte) error {
+	return write(wtr, records, FlagAligned)
+}
+
+func write(wtr io.Writer, records [][]byte, flags uint16) error {
+	recordIndexes := make([]uint32, len(records))
+
+	var recordIndex uint32
+	for i, record := range records {
+		recordIndexes[i] = recordIndex
+		recordIndex += uint32(len(record))
+	}
+
 	header := Header{
 		MagicBytes:  FileFormatMagicBytes,
 		UnixEpochUs: UnixEpochUs(),
 		Version:     FileFormatVersion,
 		NumRecords:  uint32(len(records)),
+		RecordsSize: recordIndex,
+		Flags:       flags,
 	}
 
 	err := binary.Write(wtr, byteOrder, header)
@@ -45,58 +95,222 @@ func Write(wtr io.Writer, records [][]byte) error {
 		return fmt.Errorf("writing header: %w", err)
 	}
 
-	recordIndexes := make([]uint32, len(records))
-
-	var recordIndex uint32
-	for i, record := range records {
-		recordIndexes[i] = recordIndex
-		recordIndex += uint32(len(record))
-	}
-
 	err = binary.Write(wtr, byteOrder, recordIndexes)
 	if err != nil {
 		return fmt.Errorf("writing record indexes %d: %w", recordIndex, err)
 	}
 
+	indexEnd := int64(HeaderBytes) + int64(len(records))*recordIndexSize
+	err = writePadding(wtr, dataOffset(header)-indexEnd)
+	if err != nil {
+		return fmt.Errorf("writing record index padding: %w", err)
+	}
+
 	for i, record := range records {
 		err = binary.Write(wtr, byteOrder, record)
 		if err != nil {
 			return fmt.Errorf("writing record %d/%d: %w", i+1, len(records), err)
 		}
 	}
+
+	if flags&FlagAligned != 0 {
+		fileEnd := dataOffset(header) + int64(recordIndex)
+		err = writePadding(wtr, alignUp(fileEnd)-fileEnd)
+		if err != nil {
+			return fmt.Errorf("writing records padding: %w", err)
+		}
+	}
+
 	return nil
 }
 
-var ErrOutOfBounds = fmt.Errorf("attempting to read out of bounds record")
+func writePadding(wtr io.Writer, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	_, err := wtr.Write(make([]byte, n))
+	return err
+}
+
+// dataOffset returns the file offset of the records section.
+func dataOffset(header Header) int64 {
+	offset := int64(HeaderBytes) + int64(header.NumRecords)*recordIndexSize
+	if header.Flags&FlagAligned != 0 {
+		offset = alignUp(offset)
+	}
+	return offset
+}
+
+func alignUp(offset int64) int64 {
+	return (offset + Alignment - 1) / Alignment * Alignment
+}
+
+var (
+	ErrOutOfBounds = fmt.Errorf("attempting to read out of bounds record")
+	ErrBadFormat   = fmt.Errorf("bad record batch format")
+)
 
 type RecordBatch struct {
 	Header      Header
 	recordIndex []uint32
+	dataOffset  int64
+	recordsEnd  uint32
 	rdr         io.ReadSeeker
 }
 
 // Parse parses a RecordBatch file and returns a RecordBatch which can be used
-// to read individual records.
+// to read individual records. ErrBadFormat is returned if the file is not a
+// valid RecordBatch file.
+//
+// Data following the last record of a version 2 file is ignored.
 func Parse(rdr io.ReadSeeker) (*RecordBatch, error) {
-	header := Header{}
-	err := binary.Read(rdr, byteOrder, &header)
+	fileSize, err := rdr.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, fmt.Errorf("reading header: %w", err)
+		return nil, fmt.Errorf("seeking to end of file: %w", err)
+	}
+
+	if fileSize < HeaderBytes {
+		return nil, fmt.Errorf("file size %d too small for header: %w", fileSize, ErrBadFormat)
 	}
 
-	recordIndices := make([]uint32, header.NumRecords)
-	err = binary.Read(rdr, byteOrder, &recordIndices)
+	_, err = rdr.Seek(0, io.SeekStart)
 	if err != nil {
-		return nil, fmt.Errorf("reading record index: %w", err)
+		return nil, fmt.Errorf("seeking to start of file: %w", err)
+	}
+
+	header, err := ParseHeader(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Flags&FlagIndexFooter != 0 {
+		return parseIndexFooter(rdr, header, fileSize)
+	}
+
+	dataOffset := dataOffset(header)
+	if dataOffset > fileSize {
+		return nil, fmt.Errorf("record index of %d records exceeds file size %d: %w", header.NumRecords, fileSize, ErrBadFormat)
+	}
+
+	var recordsEnd uint32
+	switch header.Version {
+	case 1:
+		recordsEnd = uint32(fileSize - dataOffset)
+	case 2:
+		recordsEnd = header.RecordsSize
+		if dataOffset+int64(recordsEnd) > fileSize {
+			return nil, fmt.Errorf("records size %d exceeds file size %d: %w", recordsEnd, fileSize, ErrBadFormat)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported version %d: %w", header.Version, ErrBadFormat)
+	}
+
+	recordIndices, err := readRecordIndex(rdr, header.NumRecords, recordsEnd)
+	if err != nil {
+		return nil, err
 	}
 
 	return &RecordBatch{
 		Header:      header,
 		recordIndex: recordIndices,
+		dataOffset:  dataOffset,
+		recordsEnd:  recordsEnd,
 		rdr:         rdr,
 	}, nil
 }
 
+// parseIndexFooter parses the remainder of a file written by Writer. The
+// returned Header has NumRecords and RecordsSize set from the footer.
+func parseIndexFooter(rdr io.ReadSeeker, header Header, fileSize int64) (*RecordBatch, error) {
+	if header.Version != 2 {
+		return nil, fmt.Errorf("index footer unsupported in version %d: %w", header.Version, ErrBadFormat)
+	}
+	if header.Flags&FlagAligned != 0 {
+		return nil, fmt.Errorf("index footer cannot be combined with alignment: %w", ErrBadFormat)
+	}
+	if fileSize < HeaderBytes+FooterBytes {
+		return nil, fmt.Errorf("file size %d too small for footer: %w", fileSize, ErrBadFormat)
+	}
+
+	_, err := rdr.Seek(fileSize-FooterBytes, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("seeking to footer: %w", err)
+	}
+
+	footer := [2]uint32{}
+	err = binary.Read(rdr, byteOrder, &footer)
+	if err != nil {
+		return nil, fmt.Errorf("reading footer: %w", err)
+	}
+	header.NumRecords, header.RecordsSize = footer[0], footer[1]
+
+	indexOffset := int64(HeaderBytes) + int64(header.RecordsSize)
+	indexEnd := indexOffset + int64(header.NumRecords)*recordIndexSize
+	if indexEnd+FooterBytes != fileSize {
+		return nil, fmt.Errorf("footer with %d records of %d bytes does not match file size %d: %w", header.NumRecords, header.RecordsSize, fileSize, ErrBadFormat)
+	}
+
+	_, err = rdr.Seek(indexOffset, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("seeking to record index: %w", err)
+	}
+
+	recordIndices, err := readRecordIndex(rdr, header.NumRecords, header.RecordsSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordBatch{
+		Header:      header,
+		recordIndex: recordIndices,
+		dataOffset:  HeaderBytes,
+		recordsEnd:  header.RecordsSize,
+		rdr:         rdr,
+	}, nil
+}
+
+// readRecordIndex reads a record index of numRecords entries from rdr and
+// verifies that offsets are increasing and within recordsEnd.
+func readRecordIndex(rdr io.Reader, numRecords uint32, recordsEnd uint32) ([]uint32, error) {
+	recordIndices := make([]uint32, numRecords)
+	err := binary.Read(rdr, byteOrder, &recordIndices)
+	if err != nil {
+		return nil, fmt.Errorf("reading record index: %w", err)
+	}
+
+	var prevRecordOffset uint32
+	for i, recordOffset := range recordIndices {
+		if recordOffset < prevRecordOffset || recordOffset > recordsEnd {
+			return nil, fmt.Errorf("record %d has invalid offset %d: %w", i, recordOffset, ErrBadFormat)
+		}
+		prevRecordOffset = recordOffset
+	}
+
+	return recordIndices, nil
+}
+
+// ParseHeader reads and validates only the header of a RecordBatch file from
+// rdr. ErrBadFormat is returned if the header is not a valid RecordBatch
+// header.
+func ParseHeader(rdr io.Reader) (Header, error) {
+	header := Header{}
+	err := binary.Read(rdr, byteOrder, &header)
+	if err != nil {
+		return Header{}, fmt.Errorf("reading header: %w", err)
+	}
+
+	if header.MagicBytes != FileFormatMagicBytes {
+		return Header{}, fmt.Errorf("unexpected magic bytes %v: %w", header.MagicBytes, ErrBadFormat)
+	}
+
+	if header.Flags&^knownFlags != 0 {
+		return Header{}, fmt.Errorf("unknown flags %b: %w", header.Flags, ErrBadFormat)
+	}
+
+	return header, nil
+}
+
 func (rb *RecordBatch) Record(recordIndex uint32) ([]byte, error) {
 	if recordIndex >= rb.Header.NumRecords {
 		return nil, fmt.Errorf("%d records available, record index %d does not exist: %w", rb.Header.NumRecords, recordIndex, ErrOutOfBounds)
@@ -104,19 +318,19 @@ func (rb *RecordBatch) Record(recordIndex uint32) ([]byte, error) {
 
 	recordOffset := rb.recordIndex[recordIndex]
 
-	fileOffset := headerBytes + rb.Header.NumRecords*recordIndexSize + recordOffset
-	_, err := rb.rdr.Seek(int64(fileOffset), io.SeekStart)
+	fileOffset := rb.dataOffset + int64(recordOffset)
+	_, err := rb.rdr.Seek(fileOffset, io.SeekStart)
 	if err != nil {
 		return nil, fmt.Errorf("seeking for record %d/%d: %w", recordIndex, len(rb.recordIndex), err)
 	}
 
-	// last record, read the remainder of the file
-	if recordIndex == uint32(len(rb.recordIndex)-1) {
-		return io.ReadAll(rb.rdr)
+	recordEnd := rb.recordsEnd
+	if recordIndex < uint32(len(rb.recordIndex)-1) {
+		recordEnd = rb.recordIndex[recordIndex+1]
 	}
 
 	// read record bytes
-	size := rb.recordIndex[recordIndex+1] - recordOffset
+	size := recordEnd - recordOffset
 	buf := make([]byte, size)
 	_, err = io.ReadFull(rb.rdr, buf)
 	if err != nil {
@@ -24,11 +24,17 @@ func TestWrite(t *testing.T) {
 		return unixEpochUs
 	}
 
+	recordsSize := 0
+	for _, record := range records {
+		recordsSize += len(record)
+	}
+
 	expectedHeader := recordbatch.Header{
 		MagicBytes:  recordbatch.FileFormatMagicBytes,
 		Version:     recordbatch.FileFormatVersion,
 		UnixEpochUs: unixEpochUs,
 		NumRecords:  uint32(len(records)),
+		RecordsSize: uint32(recordsSize),
 	}
 	buf := bytes.NewBuffer(nil)
 
@@ -120,3 +126,171 @@ func TestReadRecordOutOfBounds(t *testing.T) {
 	// Verify
 	require.ErrorIs(t, err, recordbatch.ErrOutOfBounds)
 }
+
+// TestReadRecordTrailingData verifies that records, in particular the last
+// one, are read correctly when the file contains data after the last record.
+func TestReadRecordTrailingData(t *testing.T) {
+	records := tester.MakeRandomRecordBatch(5)
+
+	buf := bytes.NewBuffer(nil)
+	err := recordbatch.Write(buf, records)
+	require.NoError(t, err)
+
+	_, err = buf.Write([]byte("trailing garbage"))
+	require.NoError(t, err)
+
+	recordBatch, err := recordbatch.Parse(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	for i, record := range records {
+		// Test
+		got, err := recordBatch.Record(uint32(i))
+
+		// Verify
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+	}
+}
+
+// TestReadRecordVersion1 verifies that version 1 files, which don't contain
+// the size of their records, can still be read.
+func TestReadRecordVersion1(t *testing.T) {
+	records := [][]byte{[]byte("first"), []byte("second"), []byte("last")}
+
+	buf := bytes.NewBuffer(nil)
+	err := binary.Write(buf, binary.LittleEndian, recordbatch.Header{
+		MagicBytes: recordbatch.FileFormatMagicBytes,
+		Version:    1,
+		NumRecords: uint32(len(records)),
+	})
+	require.NoError(t, err)
+
+	err = binary.Write(buf, binary.LittleEndian, []uint32{0, 5, 11})
+	require.NoError(t, err)
+
+	for _, record := range records {
+		_, err = buf.Write(record)
+		require.NoError(t, err)
+	}
+
+	recordBatch, err := recordbatch.Parse(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	for i, record := range records {
+		// Test
+		got, err := recordBatch.Record(uint32(i))
+
+		// Verify
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+	}
+}
+
+// TestWriteAligned verifies that WriteAligned() writes records starting at a
+// multiple of recordbatch.Alignment, pads the file to a multiple of
+// recordbatch.Alignment, and that the records can be read back.
+func TestWriteAligned(t *testing.T) {
+	records := tester.MakeRandomRecordBatch(5)
+
+	buf := bytes.NewBuffer(nil)
+
+	// Test
+	err := recordbatch.WriteAligned(buf, records)
+	require.NoError(t, err)
+
+	// Verify
+	data := buf.Bytes()
+	require.Equal(t, 0, len(data)%recordbatch.Alignment)
+	require.Equal(t, records[0], data[recordbatch.Alignment:recordbatch.Alignment+len(records[0])])
+
+	recordBatch, err := recordbatch.Parse(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, recordbatch.FlagAligned, recordBatch.Header.Flags)
+
+	for i, record := range records {
+		got, err := recordBatch.Record(uint32(i))
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+	}
+}
+
+// TestParseBadFormat verifies that Parse() returns ErrBadFormat when given
+// data that is not a valid RecordBatch.
+func TestParseBadFormat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	err := recordbatch.Write(buf, tester.MakeRandomRecordBatch(5))
+	require.NoError(t, err)
+	valid := buf.Bytes()
+
+	badMagicBytes := append([]byte{}, valid...)
+	badMagicBytes[0] = 'x'
+
+	tooManyRecords := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(tooManyRecords[14:], 1_000_000)
+
+	badRecordOffset := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badRecordOffset[32+4:], 1_000_000)
+
+	badRecordsSize := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badRecordsSize[18:], 1_000_000)
+
+	badVersion := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(badVersion[4:], 42)
+
+	unknownFlags := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(unknownFlags[22:], 1<<15)
+
+	tests := map[string][]byte{
+		"bad magic bytes":   badMagicBytes,
+		"too many records":  tooManyRecords,
+		"bad record offset": badRecordOffset,
+		"bad records size":  badRecordsSize,
+		"bad version":       badVersion,
+		"unknown flags":     unknownFlags,
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Test
+			_, err := recordbatch.Parse(bytes.NewReader(data))
+
+			// Verify
+			require.ErrorIs(t, err, recordbatch.ErrBadFormat)
+		})
+	}
+}
+
+// FuzzParse verifies that Parse() and Record() don't panic on arbitrary input.
+func FuzzParse(f *testing.F) {
+	for _, numRecords := range []int{0, 1, 5} {
+		buf := bytes.NewBuffer(nil)
+		err := recordbatch.Write(buf, tester.MakeRandomRecordBatch(numRecords))
+		require.NoError(f, err)
+		f.Add(buf.Bytes())
+
+		buf = bytes.NewBuffer(nil)
+		err = recordbatch.WriteAligned(buf, tester.MakeRandomRecordBatch(numRecords))
+		require.NoError(f, err)
+		f.Add(buf.Bytes())
+
+		buf = bytes.NewBuffer(nil)
+		wtr := recordbatch.NewWriter(buf)
+		for _, record := range tester.MakeRandomRecordBatch(numRecords) {
+			require.NoError(f, wtr.Append(record))
+		}
+		require.NoError(f, wtr.Close())
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		recordBatch, err := recordbatch.Parse(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		for i := uint32(0); i < recordBatch.Header.NumRecords; i++ {
+			_, err := recordBatch.Record(i)
+			require.NoError(t, err)
+		}
+	})
+}
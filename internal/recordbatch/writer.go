@@ -0,0 +1,117 @@
+package recordbatch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// FooterBytes is the size of the footer of files written by Writer; the
+// number of records and the size of the records section, both uint32.
+const FooterBytes = 8
+
+var ErrWriterClosed = fmt.Errorf("record batch writer closed")
+
+// Writer writes a RecordBatch file one record at a time. Records are written
+// to the underlying writer as they are appended; only the record index is
+// kept in memory. The record index and the number of records are written in
+// a footer when the Writer is closed, and files are marked with
+// FlagIndexFooter.
+//
+// Writer is not safe for concurrent use.
+type Writer struct {
+	wtr           io.Writer
+	recordIndexes []uint32
+	recordsSize   uint32
+	wroteHeader   bool
+	closed        bool
+	err           error
+}
+
+// NewWriter returns a Writer that writes a RecordBatch file to wtr.
+func NewWriter(wtr io.Writer) *Writer {
+	return &Writer{wtr: wtr}
+}
+
+// Append writes record to the underlying writer. If Append returns an error,
+// the file is incomplete and all subsequent calls return the same error.
+func (w *Writer) Append(record []byte) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	if uint64(w.recordsSize)+uint64(len(record)) > math.MaxUint32 {
+		w.err = fmt.Errorf("records size exceeds %d bytes", uint32(math.MaxUint32))
+		return w.err
+	}
+
+	if !w.wroteHeader {
+		err := w.writeHeader()
+		if err != nil {
+			w.err = fmt.Errorf("writing header: %w", err)
+			return w.err
+		}
+	}
+
+	_, err := w.wtr.Write(record)
+	if err != nil {
+		w.err = fmt.Errorf("writing record %d: %w", len(w.recordIndexes)+1, err)
+		return w.err
+	}
+
+	w.recordIndexes = append(w.recordIndexes, w.recordsSize)
+	w.recordsSize += uint32(len(record))
+
+	return nil
+}
+
+// Close writes the record index and footer, completing the file. Close does
+// not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if !w.wroteHeader {
+		err := w.writeHeader()
+		if err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+	}
+
+	err := binary.Write(w.wtr, byteOrder, w.recordIndexes)
+	if err != nil {
+		return fmt.Errorf("writing record indexes: %w", err)
+	}
+
+	footer := [2]uint32{uint32(len(w.recordIndexes)), w.recordsSize}
+	err = binary.Write(w.wtr, byteOrder, footer)
+	if err != nil {
+		return fmt.Errorf("writing footer: %w", err)
+	}
+
+	return nil
+}
+
+// writeHeader writes a header without NumRecords and RecordsSize, since
+// they're not known until the Writer is closed.
+func (w *Writer) writeHeader() error {
+	w.wroteHeader = true
+
+	header := Header{
+		MagicBytes:  FileFormatMagicBytes,
+		UnixEpochUs: UnixEpochUs(),
+		Version:     FileFormatVersion,
+		Flags:       FlagIndexFooter,
+	}
+	return binary.Write(w.wtr, byteOrder, header)
+}
@@ -0,0 +1,126 @@
+package recordbatch_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWriterAppend verifies that records appended to a Writer are written
+// to the underlying writer before Close() is called, and that the completed
+// file can be parsed and its records read back.
+func TestWriterAppend(t *testing.T) {
+	records := tester.MakeRandomRecordBatch(5)
+
+	buf := bytes.NewBuffer(nil)
+	wtr := recordbatch.NewWriter(buf)
+
+	// Test
+	recordsSize := 0
+	for _, record := range records {
+		err := wtr.Append(record)
+		require.NoError(t, err)
+
+		recordsSize += len(record)
+		require.Equal(t, recordbatch.HeaderBytes+recordsSize, buf.Len())
+	}
+
+	err := wtr.Close()
+	require.NoError(t, err)
+
+	// Verify
+	recordBatch, err := recordbatch.Parse(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, recordbatch.FlagIndexFooter, recordBatch.Header.Flags)
+	require.EqualValues(t, len(records), recordBatch.Header.NumRecords)
+	require.EqualValues(t, recordsSize, recordBatch.Header.RecordsSize)
+
+	for i, record := range records {
+		got, err := recordBatch.Record(uint32(i))
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+	}
+
+	_, err = recordBatch.Record(uint32(len(records)))
+	require.ErrorIs(t, err, recordbatch.ErrOutOfBounds)
+}
+
+// TestWriterEmpty verifies that closing a Writer without appending records
+// writes a valid RecordBatch with zero records.
+func TestWriterEmpty(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	wtr := recordbatch.NewWriter(buf)
+
+	// Test
+	err := wtr.Close()
+	require.NoError(t, err)
+
+	// Verify
+	recordBatch, err := recordbatch.Parse(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, recordBatch.Header.NumRecords)
+}
+
+// TestWriterClosed verifies that Append() and Close() return
+// ErrWriterClosed after the Writer has been closed.
+func TestWriterClosed(t *testing.T) {
+	wtr := recordbatch.NewWriter(bytes.NewBuffer(nil))
+	require.NoError(t, wtr.Close())
+
+	// Test
+	appendErr := wtr.Append([]byte("record"))
+	closeErr := wtr.Close()
+
+	// Verify
+	require.ErrorIs(t, appendErr, recordbatch.ErrWriterClosed)
+	require.ErrorIs(t, closeErr, recordbatch.ErrWriterClosed)
+}
+
+// TestParseIndexFooterBadFormat verifies that Parse() returns ErrBadFormat
+// when the footer of a file written by Writer is inconsistent with the file.
+func TestParseIndexFooterBadFormat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	wtr := recordbatch.NewWriter(buf)
+	for _, record := range tester.MakeRandomRecordBatch(5) {
+		require.NoError(t, wtr.Append(record))
+	}
+	require.NoError(t, wtr.Close())
+	valid := buf.Bytes()
+
+	truncated := valid[:len(valid)-3]
+
+	tooManyRecords := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(tooManyRecords[len(valid)-8:], 6)
+
+	badRecordsSize := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badRecordsSize[len(valid)-4:], 1_000_000)
+
+	badRecordOffset := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badRecordOffset[len(valid)-8-4:], 1_000_000)
+
+	aligned := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(aligned[22:], recordbatch.FlagIndexFooter|recordbatch.FlagAligned)
+
+	tests := map[string][]byte{
+		"truncated":         truncated,
+		"too many records":  tooManyRecords,
+		"bad records size":  badRecordsSize,
+		"bad record offset": badRecordOffset,
+		"aligned":           aligned,
+		"header only":       valid[:recordbatch.HeaderBytes],
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Test
+			_, err := recordbatch.Parse(bytes.NewReader(data))
+
+			// Verify
+			require.ErrorIs(t, err, recordbatch.ErrBadFormat)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Ring maps topics to brokers using consistent hashing, such that adding or
+// removing a broker only moves the topics of a small fraction of the ring.
+// Every client using the same brokers and virtual node count maps topics to
+// the same brokers.
+type Ring struct {
+	brokers []string
+
+	// points are sorted by hash
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	broker string
+}
+
+// NewRing returns a Ring of the given brokers, each placed on the ring
+// virtualNodes times to even out the distribution of topics.
+func NewRing(brokers []string, virtualNodes int) (*Ring, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("at least one broker required")
+	}
+	if virtualNodes < 1 {
+		return nil, fmt.Errorf("virtual nodes must be at least 1, got %d", virtualNodes)
+	}
+
+	seen := make(map[string]struct{}, len(brokers))
+	points := make([]ringPoint, 0, len(brokers)*virtualNodes)
+	for _, broker := range brokers {
+		if _, ok := seen[broker]; ok {
+			return nil, fmt.Errorf("duplicate broker '%s'", broker)
+		}
+		seen[broker] = struct{}{}
+
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, ringPoint{
+				hash:   hash(fmt.Sprintf("%s#%d", broker, i)),
+				broker: broker,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].broker < points[j].broker
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	return &Ring{
+		brokers: append([]string{}, brokers...),
+		points:  points,
+	}, nil
+}
+
+// Broker returns the broker that owns topic.
+func (r *Ring) Broker(topic string) string {
+	h := hash(topic)
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		// wrap around
+		i = 0
+	}
+
+	return r.points[i].broker
+}
+
+// Brokers returns the brokers of the ring.
+func (r *Ring) Brokers() []string {
+	return append([]string{}, r.brokers...)
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -0,0 +1,89 @@
+package routing_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/routing"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRingDeterministic verifies that rings with the same brokers map topics
+// to the same brokers, regardless of the order the brokers are given in.
+func TestRingDeterministic(t *testing.T) {
+	ring1, err := routing.NewRing([]string{"broker1", "broker2", "broker3"}, 64)
+	require.NoError(t, err)
+
+	ring2, err := routing.NewRing([]string{"broker3", "broker1", "broker2"}, 64)
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		require.Equal(t, ring1.Broker(topic), ring2.Broker(topic))
+	}
+}
+
+// TestRingDistribution verifies that topics are spread across all brokers.
+func TestRingDistribution(t *testing.T) {
+	brokers := []string{"broker1", "broker2", "broker3", "broker4"}
+	ring, err := routing.NewRing(brokers, 128)
+	require.NoError(t, err)
+
+	const numTopics = 10_000
+
+	counts := map[string]int{}
+	for i := 0; i < numTopics; i++ {
+		counts[ring.Broker(fmt.Sprintf("topic%d", i))] += 1
+	}
+
+	// Verify
+	for _, broker := range brokers {
+		// each broker should own roughly a quarter of the topics
+		require.Greater(t, counts[broker], numTopics/len(brokers)/2)
+	}
+}
+
+// TestRingAddBrokerMovesFewTopics verifies that adding a broker only moves
+// topics to the new broker, and only a fraction of them.
+func TestRingAddBrokerMovesFewTopics(t *testing.T) {
+	ring1, err := routing.NewRing([]string{"broker1", "broker2", "broker3"}, 128)
+	require.NoError(t, err)
+
+	ring2, err := routing.NewRing([]string{"broker1", "broker2", "broker3", "broker4"}, 128)
+	require.NoError(t, err)
+
+	const numTopics = 10_000
+
+	moved := 0
+	for i := 0; i < numTopics; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		before, after := ring1.Broker(topic), ring2.Broker(topic)
+		if before != after {
+			require.Equal(t, "broker4", after)
+			moved += 1
+		}
+	}
+
+	// roughly a quarter of the topics should move
+	require.Less(t, moved, numTopics/2)
+}
+
+// TestRingInvalidInput verifies that NewRing returns an error when given no
+// brokers, duplicate brokers, or too few virtual nodes.
+func TestRingInvalidInput(t *testing.T) {
+	tests := map[string]struct {
+		brokers      []string
+		virtualNodes int
+	}{
+		"no brokers":        {brokers: nil, virtualNodes: 1},
+		"duplicate brokers": {brokers: []string{"broker1", "broker1"}, virtualNodes: 1},
+		"no virtual nodes":  {brokers: []string{"broker1"}, virtualNodes: 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := routing.NewRing(test.brokers, test.virtualNodes)
+			require.Error(t, err)
+		})
+	}
+}
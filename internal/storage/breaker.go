@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrProduceFrozen is returned when adding records while a Breaker is open.
+var ErrProduceFrozen = fmt.Errorf("produce frozen after consecutive storage failures")
+
+// Breaker is a circuit breaker that freezes adding records after a number of
+// consecutive backing storage failures, such that callers fail fast instead
+// of waiting for a failing backing storage to time out. ErrFileExists is a
+// naming conflict rather than a failure of the backing storage, and is not
+// counted.
+//
+// There is no background probing: while frozen, the first add after each
+// probe interval is let through to the backing storage, and the caller
+// making it gets the backing storage's error if it is still failing. The
+// first successful add unfreezes the Breaker.
+//
+// A Breaker can be shared between Storages to freeze produce for all topics
+// at once, or be used by a single Storage to freeze a single topic.
+type Breaker struct {
+	mu            sync.Mutex
+	maxFailures   int
+	probeInterval time.Duration
+	failures      int
+	nextProbe     time.Time
+	lastErr       error
+
+	now func() time.Time
+}
+
+// NewBreaker returns a Breaker that freezes after maxFailures consecutive
+// failures and probes for recovery every probeInterval. A Breaker with a
+// maxFailures of zero or less never freezes.
+func NewBreaker(maxFailures int, probeInterval time.Duration) *Breaker {
+	return &Breaker{
+		maxFailures:   maxFailures,
+		probeInterval: probeInterval,
+		now:           time.Now,
+	}
+}
+
+// Frozen returns whether the Breaker is currently frozen.
+func (b *Breaker) Frozen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.frozen()
+}
+
+func (b *Breaker) frozen() bool {
+	return b.maxFailures > 0 && b.failures >= b.maxFailures
+}
+
+// allow returns ErrProduceFrozen, wrapping the most recent failure, if the
+// Breaker is frozen and it is not yet time to probe.
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.frozen() {
+		return nil
+	}
+
+	now := b.now()
+	if now.Before(b.nextProbe) {
+		return fmt.Errorf("%w (%d failures, last: %s)", ErrProduceFrozen, b.failures, b.lastErr)
+	}
+
+	// let this add through as a probe; others stay frozen until the next
+	// probe interval
+	b.nextProbe = now.Add(b.probeInterval)
+	return nil
+}
+
+// record records the outcome of an add.
+func (b *Breaker) record(err error) {
+	if errors.Is(err, ErrFileExists) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.lastErr = nil
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+	if b.failures == b.maxFailures {
+		b.nextProbe = b.now().Add(b.probeInterval)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+var errBackingStorage = fmt.Errorf("backing storage failure")
+
+// failingBackingStorage is a MemoryStorage whose writes fail while fail is
+// true.
+type failingBackingStorage struct {
+	*MemoryStorage
+	fail bool
+}
+
+func (fbs *failingBackingStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
+	if fbs.fail {
+		return nil, errBackingStorage
+	}
+	return fbs.MemoryStorage.Writer(recordBatchPath)
+}
+
+// TestBreakerFreezesAndProbes verifies that AddRecordBatch() returns
+// ErrProduceFrozen without hitting the backing storage after the configured
+// number of consecutive failures, that a single probe is let through every
+// probe interval, and that a successful probe unfreezes the Breaker.
+func TestBreakerFreezesAndProbes(t *testing.T) {
+	const probeInterval = time.Minute
+
+	now := time.Now()
+	breaker := NewBreaker(3, probeInterval)
+	breaker.now = func() time.Time {
+		return now
+	}
+
+	backingStorage := &failingBackingStorage{MemoryStorage: &MemoryStorage{}, fail: true}
+	s, err := NewStorage(log, backingStorage, "/", "mytopic")
+	require.NoError(t, err)
+	s.Breaker = breaker
+
+	// Test, Verify
+	for i := 0; i < 3; i++ {
+		_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+		require.ErrorIs(t, err, errBackingStorage)
+	}
+	require.True(t, breaker.Frozen())
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.ErrorIs(t, err, ErrProduceFrozen)
+
+	// failing probe keeps the breaker frozen until the next probe
+	now = now.Add(probeInterval)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.ErrorIs(t, err, errBackingStorage)
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.ErrorIs(t, err, ErrProduceFrozen)
+
+	// successful probe unfreezes the breaker
+	backingStorage.fail = false
+	now = now.Add(probeInterval)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+	require.False(t, breaker.Frozen())
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+}
+
+// TestBreakerIgnoresFileExists verifies that ErrFileExists doesn't count as
+// a backing storage failure, and that a Breaker with a maxFailures of zero
+// never freezes.
+func TestBreakerIgnoresFileExists(t *testing.T) {
+	breaker := NewBreaker(1, time.Minute)
+	never := NewBreaker(0, time.Minute)
+
+	// Test
+	for i := 0; i < 3; i++ {
+		breaker.record(fmt.Errorf("closing writer: %w", ErrFileExists))
+		never.record(errBackingStorage)
+	}
+
+	// Verify
+	require.False(t, breaker.Frozen())
+	require.NoError(t, breaker.allow())
+
+	require.False(t, never.Frozen())
+	require.NoError(t, never.allow())
+}
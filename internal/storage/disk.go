@@ -3,36 +3,74 @@ package storage
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/micvbang/go-helpy/filepathy"
+	"github.com/micvbang/go-helpy/filey"
 	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
 )
 
-const recordBatchExtension = ".record_batch"
+const (
+	recordBatchExtension = ".record_batch"
+	tmpExtension         = ".tmp"
+)
+
+type DiskStorage struct {
+	// Modes configures the permissions of created topic directories and
+	// record batch files.
+	Modes FileModes
 
-type DiskStorage struct{}
+	// Pool, if set, keeps record batch files open between reads.
+	Pool *FilePool
+}
 
 func NewDiskStorage(log logger.Logger, rootDir string, topic string) (*Storage, error) {
 	return NewStorage(log, DiskStorage{}, rootDir, topic)
 }
 
-func (DiskStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
-	err := os.MkdirAll(filepath.Dir(recordBatchPath), os.ModePerm)
+func (ds DiskStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
+	recordBatchPath = filepath.FromSlash(recordBatchPath)
+
+	err := ds.Modes.mkdirAll(filepath.Dir(recordBatchPath))
 	if err != nil {
 		return nil, fmt.Errorf("creating topic dir: %w", err)
 	}
 
-	f, err := os.Create(recordBatchPath)
-	if err != nil {
-		return nil, fmt.Errorf("opening file '%s': %w", recordBatchPath, err)
+	if filey.Exists(recordBatchPath) {
+		return nil, fmt.Errorf("'%s': %w", recordBatchPath, ErrFileExists)
 	}
 
-	return f, nil
+	// write to a temporary file that is linked into place on Close(), such
+	// that partially written record batches are never visible and
+	// concurrent writers can't overwrite each other's record batches
+	for {
+		tmpPath := fmt.Sprintf("%s.%s%s", recordBatchPath, strconv.FormatUint(rand.Uint64(), 36), tmpExtension)
+		f, err := ds.Modes.createNew(tmpPath)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("opening file '%s': %w", tmpPath, err)
+		}
+
+		return &diskWriteCloser{File: f, tmpPath: tmpPath, path: recordBatchPath}, nil
+	}
 }
 
-func (DiskStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
+func (ds DiskStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
+	recordBatchPath = filepath.FromSlash(recordBatchPath)
+
+	if ds.Pool != nil {
+		f, err := ds.Pool.Open(recordBatchPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening record batch '%s': %w", recordBatchPath, err)
+		}
+		return f, nil
+	}
+
 	f, err := os.Open(recordBatchPath)
 	if err != nil {
 		return nil, fmt.Errorf("opening record batch '%s': %w", recordBatchPath, err)
@@ -41,14 +79,60 @@ func (DiskStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
 	return f, nil
 }
 
+func (ds DiskStorage) Delete(recordBatchPath string) error {
+	recordBatchPath = filepath.FromSlash(recordBatchPath)
+
+	if ds.Pool != nil {
+		ds.Pool.Remove(recordBatchPath)
+	}
+
+	err := os.Remove(recordBatchPath)
+	if err != nil {
+		return fmt.Errorf("deleting record batch '%s': %w", recordBatchPath, err)
+	}
+
+	return nil
+}
+
 func (DiskStorage) ListFiles(topicPath string, extension string) ([]string, error) {
 	filePaths := make([]string, 0, 128)
 
-	walkConfig := filepathy.WalkConfig{Files: true, Extensions: []string{extension}}
-	err := filepathy.Walk(topicPath, walkConfig, func(path string, info os.FileInfo, _ error) error {
+	walkConfig := filepathy.WalkConfig{Files: true}
+	if extension != "" {
+		walkConfig.Extensions = []string{extension}
+	}
+	err := filepathy.Walk(filepath.FromSlash(topicPath), walkConfig, func(path string, info os.FileInfo, _ error) error {
 		filePaths = append(filePaths, info.Name())
 		return nil
 	})
 
 	return filePaths, err
 }
+
+// diskWriteCloser writes a record batch to a temporary file, which is linked
+// to the record batch's path on Close(). Linking fails if a file already
+// exists at the path, in which case ErrFileExists is returned.
+type diskWriteCloser struct {
+	*os.File
+	tmpPath string
+	path    string
+}
+
+func (dwc *diskWriteCloser) Close() error {
+	defer os.Remove(dwc.tmpPath)
+
+	err := dwc.File.Close()
+	if err != nil {
+		return fmt.Errorf("closing file '%s': %w", dwc.tmpPath, err)
+	}
+
+	err = os.Link(dwc.tmpPath, dwc.path)
+	if os.IsExist(err) {
+		return fmt.Errorf("'%s': %w", dwc.path, ErrFileExists)
+	}
+	if err != nil {
+		return fmt.Errorf("linking '%s' to '%s': %w", dwc.tmpPath, dwc.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package storage_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackingStorageNoOverwrite verifies that backing storages return
+// ErrFileExists instead of overwriting a record batch, also when two writers
+// for the same record batch are open at the same time.
+func TestBackingStorageNoOverwrite(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	backingStorages := map[string]storage.BackingStorage{
+		"disk":   storage.DiskStorage{},
+		"memory": &storage.MemoryStorage{},
+	}
+
+	for name, backingStorage := range backingStorages {
+		backingStorage := backingStorage
+		t.Run(name, func(t *testing.T) {
+			rbPath := filepath.ToSlash(filepath.Join(tempDir, name, "000000000000.record_batch"))
+
+			w1, err := backingStorage.Writer(rbPath)
+			require.NoError(t, err)
+			w2, err := backingStorage.Writer(rbPath)
+			require.NoError(t, err)
+
+			_, err = w1.Write([]byte("first"))
+			require.NoError(t, err)
+			_, err = w2.Write([]byte("second"))
+			require.NoError(t, err)
+
+			// Test
+			require.NoError(t, w1.Close())
+			err = w2.Close()
+
+			// Verify
+			require.ErrorIs(t, err, storage.ErrFileExists)
+
+			_, err = backingStorage.Writer(rbPath)
+			require.ErrorIs(t, err, storage.ErrFileExists)
+
+			rdr, err := backingStorage.Reader(rbPath)
+			require.NoError(t, err)
+			defer rdr.Close()
+
+			got, err := io.ReadAll(rdr)
+			require.NoError(t, err)
+			require.Equal(t, "first", string(got))
+		})
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(tempDir, "disk"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
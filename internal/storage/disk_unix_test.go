@@ -0,0 +1,81 @@
+//go:build !windows
+
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDiskStorageFileModes verifies that DiskStorage creates topic directories
+// and record batch files with the configured modes, regardless of the
+// process' umask.
+func TestDiskStorageFileModes(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	// restrictive umask that would otherwise remove group permissions
+	oldUmask := syscall.Umask(0o077)
+	defer syscall.Umask(oldUmask)
+
+	diskStorage := storage.DiskStorage{
+		Modes: storage.FileModes{Dir: 0o750, File: 0o640},
+	}
+
+	s, err := storage.NewStorage(log, diskStorage, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	// Test
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// Verify
+	dirInfo, err := os.Stat(filepath.Join(tempDir, "mytopic"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o750), dirInfo.Mode().Perm())
+
+	fileInfo, err := os.Stat(filepath.Join(tempDir, "mytopic", "00000000000000000000.record_batch"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), fileInfo.Mode().Perm())
+}
+
+// TestDiskStorageDirModesParents verifies that the configured directory mode
+// is applied to all directories created for a topic, including missing
+// parents of the root directory, but not to directories that already exist.
+func TestDiskStorageDirModesParents(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(tempDir, 0o700))
+
+	oldUmask := syscall.Umask(0o077)
+	defer syscall.Umask(oldUmask)
+
+	diskStorage := storage.DiskStorage{
+		Modes: storage.FileModes{Dir: 0o750, File: 0o640},
+	}
+
+	rootDir := filepath.Join(tempDir, "a", "b")
+	s, err := storage.NewStorage(log, diskStorage, rootDir, "mytopic")
+	require.NoError(t, err)
+
+	// Test
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// Verify
+	for _, dir := range []string{filepath.Join(tempDir, "a"), rootDir, filepath.Join(rootDir, "mytopic")} {
+		dirInfo, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o750), dirInfo.Mode().Perm(), dir)
+	}
+
+	dirInfo, err := os.Stat(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), dirInfo.Mode().Perm())
+}
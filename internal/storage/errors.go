@@ -2,4 +2,14 @@ package storage
 
 import "fmt"
 
-var ErrOutOfBounds = fmt.Errorf("out of bounds")
+var (
+	ErrOutOfBounds = fmt.Errorf("out of bounds")
+
+	// ErrRecordDeleted is returned when reading records older than the oldest
+	// record of a topic, e.g. because they were deleted by retention. It
+	// wraps ErrOutOfBounds.
+	ErrRecordDeleted = fmt.Errorf("record deleted: %w", ErrOutOfBounds)
+
+	// ErrInvalidCount is returned when reading a negative number of records.
+	ErrInvalidCount = fmt.Errorf("invalid count")
+)
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileModes configures the permissions of directories and files created on
+// the local file system. Zero values use the defaults of os.MkdirAll() and
+// os.Create(), subject to the process' umask. Non-zero values are applied
+// exactly, regardless of the umask.
+type FileModes struct {
+	Dir  os.FileMode
+	File os.FileMode
+}
+
+// mkdirAll creates dir, including any missing parents, using the configured
+// directory mode. The mode is applied to all directories that are created,
+// but not to those that already exist.
+func (fm FileModes) mkdirAll(dir string) error {
+	if fm.Dir == 0 {
+		return os.MkdirAll(dir, os.ModePerm)
+	}
+
+	// directories that don't exist yet, innermost first
+	missing := []string{}
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		_, err := os.Stat(d)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, d)
+
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	err := os.MkdirAll(dir, fm.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range missing {
+		err = os.Chmod(d, fm.Dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// create creates or truncates the file at path using the configured file mode.
+func (fm FileModes) create(path string) (*os.File, error) {
+	if fm.File == 0 {
+		return os.Create(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fm.File)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Chmod(fm.File)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// createNew creates the file at path using the configured file mode. An
+// error satisfying os.IsExist() is returned if the file already exists.
+func (fm FileModes) createNew(path string) (*os.File, error) {
+	mode := fm.File
+	if mode == 0 {
+		mode = 0o666
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if fm.File != 0 {
+		err = f.Chmod(fm.File)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FilePool keeps files open for reading, such that repeated reads of the same
+// files don't require opening them again. When more than maxOpen files are
+// open, the least recently used files that aren't being read are closed.
+//
+// FilePool must only be used for files that are not modified while open.
+type FilePool struct {
+	mu      sync.Mutex
+	maxOpen int
+	files   map[string]*pooledFile
+
+	// lru contains *pooledFile, most recently used at the front
+	lru *list.List
+}
+
+type pooledFile struct {
+	path string
+	f    *os.File
+	size int64
+	refs int
+	elem *list.Element
+
+	// removed is set when the file has been removed from the pool while
+	// being read; it is closed once the last reader is closed.
+	removed bool
+}
+
+func NewFilePool(maxOpen int) *FilePool {
+	return &FilePool{
+		maxOpen: maxOpen,
+		files:   make(map[string]*pooledFile),
+		lru:     list.New(),
+	}
+}
+
+// Open returns a reader for the file at path. The file is kept open in the
+// pool when the returned reader is closed.
+func (fp *FilePool) Open(path string) (io.ReadSeekCloser, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	pf, ok := fp.files[path]
+	if ok {
+		fp.lru.MoveToFront(pf.elem)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading file info: %w", err)
+		}
+
+		pf = &pooledFile{path: path, f: f, size: info.Size()}
+		pf.elem = fp.lru.PushFront(pf)
+		fp.files[path] = pf
+	}
+
+	pf.refs += 1
+	fp.evict()
+
+	return &pooledReader{
+		SectionReader: io.NewSectionReader(pf.f, 0, pf.size),
+		release: func() {
+			fp.release(pf)
+		},
+	}, nil
+}
+
+// Close closes all files in the pool, including those that are being read.
+func (fp *FilePool) Close() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	var err error
+	for path, pf := range fp.files {
+		closeErr := pf.f.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("closing '%s': %w", path, closeErr)
+		}
+	}
+
+	fp.files = make(map[string]*pooledFile)
+	fp.lru.Init()
+
+	return err
+}
+
+// Remove removes the file at path from the pool, e.g. because the file is
+// about to be deleted. The file is closed once it is no longer being read.
+func (fp *FilePool) Remove(path string) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	pf, ok := fp.files[path]
+	if !ok {
+		return
+	}
+
+	fp.lru.Remove(pf.elem)
+	delete(fp.files, path)
+
+	pf.removed = true
+	if pf.refs == 0 {
+		pf.f.Close()
+	}
+}
+
+func (fp *FilePool) release(pf *pooledFile) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	pf.refs -= 1
+	if pf.removed {
+		if pf.refs == 0 {
+			pf.f.Close()
+		}
+		return
+	}
+	fp.evict()
+}
+
+// evict closes the least recently used files that aren't being read until
+// at most maxOpen files are open. fp.mu must be held.
+func (fp *FilePool) evict() {
+	elem := fp.lru.Back()
+	for len(fp.files) > fp.maxOpen && elem != nil {
+		pf := elem.Value.(*pooledFile)
+		elem = elem.Prev()
+
+		if pf.refs > 0 {
+			continue
+		}
+
+		pf.f.Close()
+		fp.lru.Remove(pf.elem)
+		delete(fp.files, pf.path)
+	}
+}
+
+type pooledReader struct {
+	*io.SectionReader
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (pr *pooledReader) Close() error {
+	pr.releaseOnce.Do(pr.release)
+	return nil
+}
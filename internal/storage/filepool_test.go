@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFilePoolMaxOpen verifies that FilePool closes the least recently used
+// files when more than maxOpen files are open, and that files can be read
+// correctly after having been closed.
+func TestFilePoolMaxOpen(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	const maxOpen = 2
+	fp := NewFilePool(maxOpen)
+	defer fp.Close()
+
+	paths := make([]string, 5)
+	for i := range paths {
+		paths[i] = filepath.Join(tempDir, fmt.Sprintf("file%d", i))
+		err := os.WriteFile(paths[i], []byte(paths[i]), os.ModePerm)
+		require.NoError(t, err)
+	}
+
+	for round := 0; round < 2; round++ {
+		for _, path := range paths {
+			// Test
+			rdr, err := fp.Open(path)
+			require.NoError(t, err)
+
+			got, err := io.ReadAll(rdr)
+			require.NoError(t, err)
+			require.NoError(t, rdr.Close())
+
+			// Verify
+			require.Equal(t, path, string(got))
+			require.LessOrEqual(t, len(fp.files), maxOpen)
+		}
+	}
+}
+
+// TestFilePoolInUseNotClosed verifies that FilePool doesn't close files that
+// are being read, even when more than maxOpen files are open.
+func TestFilePoolInUseNotClosed(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	fp := NewFilePool(1)
+	defer fp.Close()
+
+	path1 := filepath.Join(tempDir, "file1")
+	path2 := filepath.Join(tempDir, "file2")
+	require.NoError(t, os.WriteFile(path1, []byte("file1"), os.ModePerm))
+	require.NoError(t, os.WriteFile(path2, []byte("file2"), os.ModePerm))
+
+	rdr1, err := fp.Open(path1)
+	require.NoError(t, err)
+
+	// Test
+	rdr2, err := fp.Open(path2)
+	require.NoError(t, err)
+
+	// Verify
+	require.Equal(t, 2, len(fp.files))
+
+	got1, err := io.ReadAll(rdr1)
+	require.NoError(t, err)
+	require.Equal(t, "file1", string(got1))
+
+	got2, err := io.ReadAll(rdr2)
+	require.NoError(t, err)
+	require.Equal(t, "file2", string(got2))
+
+	// closing readers allows files to be closed
+	require.NoError(t, rdr1.Close())
+	require.NoError(t, rdr2.Close())
+	require.Equal(t, 1, len(fp.files))
+}
+
+// TestFilePoolRemove verifies that Remove() removes a file from the pool
+// without breaking ongoing reads, and that the file is reopened on the next
+// Open().
+func TestFilePoolRemove(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	fp := NewFilePool(2)
+	defer fp.Close()
+
+	path := filepath.Join(tempDir, "file")
+	require.NoError(t, os.WriteFile(path, []byte("file"), os.ModePerm))
+
+	rdr, err := fp.Open(path)
+	require.NoError(t, err)
+
+	// Test
+	fp.Remove(path)
+
+	// Verify
+	require.Empty(t, fp.files)
+
+	got, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, "file", string(got))
+	require.NoError(t, rdr.Close())
+
+	rdr, err = fp.Open(path)
+	require.NoError(t, err)
+	require.NoError(t, rdr.Close())
+	require.Len(t, fp.files, 1)
+}
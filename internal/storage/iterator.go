@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+)
+
+// RecordIterator iterates over consecutive records of a Storage, across
+// record batch boundaries. Each record batch is only opened and parsed once.
+//
+// Usage:
+//
+//	it := s.Iterator(recordID)
+//	defer it.Close()
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if it.Err() != nil { ... }
+type RecordIterator struct {
+	s *Storage
+
+	nextRecordID uint64
+	recordID     uint64
+	record       []byte
+	err          error
+
+	recordBatchID uint64
+	recordBatch   *recordbatch.RecordBatch
+	closer        io.Closer
+}
+
+// Iterator returns a RecordIterator starting at fromRecordID. The iterator
+// stops at the last record that exists when Next() is called; records added
+// later are returned by subsequent calls to Next().
+func (s *Storage) Iterator(fromRecordID uint64) *RecordIterator {
+	return &RecordIterator{
+		s:            s,
+		nextRecordID: fromRecordID,
+	}
+}
+
+// Next advances the iterator to the next record, which is then available via
+// Record(). It returns false when there are no more records or an error
+// occurred, see Err(). If the next record has been deleted, e.g. by
+// retention, Err() returns ErrRecordDeleted; the oldest available record is
+// given by Watermarks().
+func (it *RecordIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	recordID := it.nextRecordID
+	if it.recordBatch == nil || recordID >= it.recordBatchID+uint64(it.recordBatch.Header.NumRecords) {
+		recordBatchID, err := it.s.recordBatchIDFor(recordID)
+		if errors.Is(err, ErrOutOfBounds) && !errors.Is(err, ErrRecordDeleted) {
+			// end of topic
+			return false
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.closeRecordBatch()
+		it.recordBatch, it.closer, err = it.s.openRecordBatch(recordBatchID)
+		if err != nil {
+			it.err = it.s.deletedRecordError(recordID, err)
+			return false
+		}
+		it.recordBatchID = recordBatchID
+	}
+
+	record, err := it.recordBatch.Record(uint32(recordID - it.recordBatchID))
+	if err != nil {
+		it.err = fmt.Errorf("record batch '%s': %w", it.s.recordBatchPath(it.recordBatchID), err)
+		return false
+	}
+
+	it.recordID = recordID
+	it.record = record
+	it.nextRecordID = recordID + 1
+
+	return true
+}
+
+// Record returns the record that the most recent call to Next() advanced to.
+func (it *RecordIterator) Record() []byte {
+	return it.record
+}
+
+// RecordID returns the ID of the record returned by Record().
+func (it *RecordIterator) RecordID() uint64 {
+	return it.recordID
+}
+
+// Err returns the first error encountered by Next(), if any.
+func (it *RecordIterator) Err() error {
+	return it.err
+}
+
+// Close releases the record batch currently held open by the iterator.
+func (it *RecordIterator) Close() error {
+	return it.closeRecordBatch()
+}
+
+func (it *RecordIterator) closeRecordBatch() error {
+	if it.closer == nil {
+		return nil
+	}
+
+	err := it.closer.Close()
+	it.closer = nil
+	it.recordBatch = nil
+	return err
+}
@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIteratorAcrossBatches verifies that RecordIterator returns all records,
+// in order, across record batch boundaries, starting from the given record
+// ID.
+func TestIteratorAcrossBatches(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	records := [][]byte{}
+	for _, batchSize := range []int{3, 1, 5, 2} {
+		recordBatch := tester.MakeRandomRecordBatch(batchSize)
+		records = append(records, recordBatch...)
+
+		_, err = s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+	}
+
+	for _, fromRecordID := range []int{0, 2, 3, 4, len(records) - 1} {
+		// Test
+		it := s.Iterator(uint64(fromRecordID))
+
+		got := [][]byte{}
+		recordID := uint64(fromRecordID)
+		for it.Next() {
+			require.Equal(t, recordID, it.RecordID())
+			got = append(got, it.Record())
+			recordID += 1
+		}
+
+		// Verify
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		require.Equal(t, records[fromRecordID:], got)
+	}
+}
+
+// TestIteratorNewRecords verifies that RecordIterator returns records that are
+// added after it has reached the end of the topic.
+func TestIteratorNewRecords(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+	require.NoError(t, err)
+
+	it := s.Iterator(0)
+	defer it.Close()
+
+	require.False(t, it.Next())
+
+	recordBatch := tester.MakeRandomRecordBatch(2)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	// Test, Verify
+	for _, record := range recordBatch {
+		require.True(t, it.Next())
+		require.Equal(t, record, it.Record())
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+// TestIteratorBeyondEnd verifies that RecordIterator returns no records and no
+// error when started beyond the last record.
+func TestIteratorBeyondEnd(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+	require.NoError(t, err)
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(2))
+	require.NoError(t, err)
+
+	// Test
+	it := s.Iterator(10)
+	defer it.Close()
+
+	// Verify
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+// TestIteratorDeletedRecords verifies that RecordIterator returns
+// ErrRecordDeleted, rather than reporting the end of the topic, when started
+// before the oldest record of a topic whose oldest records were deleted.
+func TestIteratorDeletedRecords(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(2))
+		require.NoError(t, err)
+	}
+
+	deleted, err := s.DeleteBefore(4)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+
+	// Test
+	it := s.Iterator(0)
+	defer it.Close()
+
+	// Verify
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), storage.ErrRecordDeleted)
+	require.ErrorIs(t, it.Err(), storage.ErrOutOfBounds)
+
+	low, _ := s.Watermarks()
+	it = s.Iterator(low)
+	defer it.Close()
+
+	require.True(t, it.Next())
+	require.Equal(t, low, it.RecordID())
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+)
+
+// Markers are files stored next to a topic's record batches that persist
+// state of the topic, e.g. that it has been sealed. Their extension
+// identifies them, and their contents are an empty record batch, such that
+// they are accepted by backing storages that only store record batches.
+
+// markerPath returns the path of the topic's marker with the given
+// extension.
+func (s *Storage) markerPath(extension string) string {
+	return path.Join(s.topicPath, "topic"+extension)
+}
+
+// writeMarker persists the topic's marker with the given extension. Writing
+// a marker that exists is a no-op.
+func (s *Storage) writeMarker(extension string) error {
+	markerPath := s.markerPath(extension)
+	f, err := s.backingStorage.Writer(markerPath)
+	if errors.Is(err, ErrFileExists) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening writer '%s': %w", markerPath, err)
+	}
+
+	err = recordbatch.Write(f, nil)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing '%s': %w", markerPath, err)
+	}
+
+	err = f.Close()
+	if err != nil && !errors.Is(err, ErrFileExists) {
+		return fmt.Errorf("closing writer '%s': %w", markerPath, err)
+	}
+
+	return nil
+}
+
+// hasExtension returns whether any of filePaths, e.g. a marker, has the
+// given extension.
+func hasExtension(filePaths []string, extension string) bool {
+	for _, filePath := range filePaths {
+		if strings.HasSuffix(filePath, extension) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+)
+
+// ErrStorageFull is returned when writing to a MemoryStorage would exceed its
+// size limit.
+var ErrStorageFull = fmt.Errorf("storage full")
+
+// MemoryStorage is a BackingStorage that keeps all record batches in memory.
+// It is useful for tests and loopback topics that shouldn't depend on disk or
+// S3.
+type MemoryStorage struct {
+	// MaxBytes is the maximum total size of stored record batches. Zero means
+	// unlimited.
+	MaxBytes int
+
+	mu        sync.Mutex
+	usedBytes int
+	files     map[string][]byte
+}
+
+func NewMemoryStorage(log logger.Logger, topic string, maxBytes int) (*Storage, error) {
+	return NewStorage(log, &MemoryStorage{MaxBytes: maxBytes}, "", topic)
+}
+
+func (ms *MemoryStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, exists := ms.files[recordBatchPath]; exists {
+		return nil, fmt.Errorf("'%s': %w", recordBatchPath, ErrFileExists)
+	}
+
+	return &memoryWriteCloser{
+		buf: bytes.NewBuffer(nil),
+		store: func(b []byte) error {
+			return ms.store(recordBatchPath, b)
+		},
+	}, nil
+}
+
+func (ms *MemoryStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	b, exists := ms.files[recordBatchPath]
+	if !exists {
+		return nil, fmt.Errorf("record batch '%s' does not exist", recordBatchPath)
+	}
+
+	return readSeekNopCloser{bytes.NewReader(b)}, nil
+}
+
+func (ms *MemoryStorage) ListFiles(topicPath string, extension string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	filePaths := make([]string, 0, len(ms.files))
+	for filePath := range ms.files {
+		if path.Dir(filePath) == topicPath && strings.HasSuffix(filePath, extension) {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	sort.Strings(filePaths)
+
+	return filePaths, nil
+}
+
+func (ms *MemoryStorage) Delete(recordBatchPath string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	b, exists := ms.files[recordBatchPath]
+	if !exists {
+		return fmt.Errorf("record batch '%s' does not exist", recordBatchPath)
+	}
+
+	delete(ms.files, recordBatchPath)
+	ms.usedBytes -= len(b)
+
+	return nil
+}
+
+func (ms *MemoryStorage) store(recordBatchPath string, b []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, exists := ms.files[recordBatchPath]; exists {
+		return fmt.Errorf("'%s': %w", recordBatchPath, ErrFileExists)
+	}
+
+	if ms.MaxBytes > 0 && ms.usedBytes+len(b) > ms.MaxBytes {
+		return fmt.Errorf("storing %d bytes with %d/%d bytes used: %w", len(b), ms.usedBytes, ms.MaxBytes, ErrStorageFull)
+	}
+
+	if ms.files == nil {
+		ms.files = make(map[string][]byte)
+	}
+	ms.files[recordBatchPath] = b
+	ms.usedBytes += len(b)
+
+	return nil
+}
+
+type memoryWriteCloser struct {
+	buf   *bytes.Buffer
+	store func([]byte) error
+}
+
+func (mwc *memoryWriteCloser) Write(b []byte) (int, error) {
+	return mwc.buf.Write(b)
+}
+
+func (mwc *memoryWriteCloser) Close() error {
+	return mwc.store(mwc.buf.Bytes())
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryStorageWriteRead verifies that records added to a Storage backed
+// by MemoryStorage can be read back.
+func TestMemoryStorageWriteRead(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+	require.NoError(t, err)
+
+	recordBatch1 := tester.MakeRandomRecordBatch(5)
+	recordBatch2 := tester.MakeRandomRecordBatch(3)
+
+	// Test
+	_, err = s.AddRecordBatch(recordBatch1)
+	require.NoError(t, err)
+
+	_, err = s.AddRecordBatch(recordBatch2)
+	require.NoError(t, err)
+
+	// Verify
+	for recordID, record := range append(recordBatch1, recordBatch2...) {
+		got, err := s.ReadRecord(uint64(recordID))
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+	}
+}
+
+// TestMemoryStorageMaxBytes verifies that adding records beyond MaxBytes
+// returns ErrStorageFull and leaves already added records readable.
+func TestMemoryStorageMaxBytes(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 256)
+	require.NoError(t, err)
+
+	recordBatch := [][]byte{[]byte("hello")}
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	// Test
+	_, err = s.AddRecordBatch([][]byte{make([]byte, 256)})
+
+	// Verify
+	require.ErrorIs(t, err, storage.ErrStorageFull)
+
+	got, err := s.ReadRecord(0)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch[0], got)
+
+	_, err = s.ReadRecord(1)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+}
+
+// TestMemoryStorageListFiles verifies that ListFiles only returns files from
+// the given topic with the given extension, in sorted order, and not those of
+// topics whose names start with the given topic's name.
+func TestMemoryStorageListFiles(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+
+	for _, path := range []string{"topic1/2.ext", "topic1/1.ext", "topic1/3.other", "topic2/1.ext", "topic10/1.ext"} {
+		wtr, err := ms.Writer(path)
+		require.NoError(t, err)
+		require.NoError(t, wtr.Close())
+	}
+
+	// Test
+	got, err := ms.ListFiles("topic1", ".ext")
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, []string{"topic1/1.ext", "topic1/2.ext"}, got)
+}
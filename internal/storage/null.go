@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+)
+
+// NullStorage is a BackingStorage that discards the contents of record
+// batches and synthesizes them again when read. Only the header of each
+// record batch is kept, so read records have the expected sizes but consist
+// of zero bytes.
+//
+// NullStorage is useful for benchmarking the CPU-side performance of the
+// broker without the cost of disk or S3.
+type NullStorage struct {
+	mu      sync.Mutex
+	headers map[string]recordbatch.Header
+}
+
+func NewNullStorage(log logger.Logger, topic string) (*Storage, error) {
+	return NewStorage(log, &NullStorage{}, "", topic)
+}
+
+func (ns *NullStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if _, exists := ns.headers[recordBatchPath]; exists {
+		return nil, fmt.Errorf("'%s': %w", recordBatchPath, ErrFileExists)
+	}
+
+	return &nullWriteCloser{
+		store: func(header recordbatch.Header) error {
+			return ns.store(recordBatchPath, header)
+		},
+	}, nil
+}
+
+func (ns *NullStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
+	ns.mu.Lock()
+	header, exists := ns.headers[recordBatchPath]
+	ns.mu.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("record batch '%s': %w", recordBatchPath, os.ErrNotExist)
+	}
+
+	records := make([][]byte, header.NumRecords)
+	if header.NumRecords > 0 {
+		recordSize := header.RecordsSize / header.NumRecords
+		for i := range records {
+			records[i] = make([]byte, recordSize)
+		}
+		records[len(records)-1] = make([]byte, recordSize+header.RecordsSize%header.NumRecords)
+	}
+
+	write := recordbatch.Write
+	switch {
+	case header.Flags&recordbatch.FlagAligned != 0:
+		write = recordbatch.WriteAligned
+	case header.Flags&recordbatch.FlagIndexFooter != 0:
+		write = writeIndexFooter
+
+		// NumRecords and RecordsSize are only stored in the footer
+		header.NumRecords, header.RecordsSize = 0, 0
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := write(buf, records)
+	if err != nil {
+		return nil, fmt.Errorf("synthesizing record batch '%s': %w", recordBatchPath, err)
+	}
+
+	// restore the stored header, e.g. its timestamp
+	headerBuf := bytes.NewBuffer(nil)
+	err = binary.Write(headerBuf, binary.LittleEndian, header)
+	if err != nil {
+		return nil, fmt.Errorf("synthesizing record batch header '%s': %w", recordBatchPath, err)
+	}
+	data := buf.Bytes()
+	copy(data, headerBuf.Bytes())
+
+	return readSeekNopCloser{bytes.NewReader(data)}, nil
+}
+
+func (ns *NullStorage) ListFiles(topicPath string, extension string) ([]string, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	filePaths := make([]string, 0, len(ns.headers))
+	for filePath := range ns.headers {
+		if path.Dir(filePath) == topicPath && strings.HasSuffix(filePath, extension) {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	sort.Strings(filePaths)
+
+	return filePaths, nil
+}
+
+func (ns *NullStorage) Delete(recordBatchPath string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if _, exists := ns.headers[recordBatchPath]; !exists {
+		return fmt.Errorf("record batch '%s': %w", recordBatchPath, os.ErrNotExist)
+	}
+	delete(ns.headers, recordBatchPath)
+
+	return nil
+}
+
+func (ns *NullStorage) store(recordBatchPath string, header recordbatch.Header) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if _, exists := ns.headers[recordBatchPath]; exists {
+		return fmt.Errorf("'%s': %w", recordBatchPath, ErrFileExists)
+	}
+
+	if ns.headers == nil {
+		ns.headers = make(map[string]recordbatch.Header)
+	}
+	ns.headers[recordBatchPath] = header
+
+	return nil
+}
+
+// writeIndexFooter writes records using recordbatch.Writer.
+func writeIndexFooter(wtr io.Writer, records [][]byte) error {
+	rbWriter := recordbatch.NewWriter(wtr)
+	for _, record := range records {
+		err := rbWriter.Append(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rbWriter.Close()
+}
+
+// nullWriteCloser keeps the header of the written record batch and discards
+// everything else. For record batches written by recordbatch.Writer, the
+// number of records and the size of the records section are taken from the
+// footer.
+type nullWriteCloser struct {
+	header bytes.Buffer
+	store  func(recordbatch.Header) error
+
+	// tail holds the last bytes written, up to recordbatch.FooterBytes
+	tail []byte
+}
+
+func (nwc *nullWriteCloser) Write(b []byte) (int, error) {
+	missing := recordbatch.HeaderBytes - nwc.header.Len()
+	if missing > 0 {
+		if missing > len(b) {
+			missing = len(b)
+		}
+		nwc.header.Write(b[:missing])
+	}
+
+	if len(b) >= recordbatch.FooterBytes {
+		nwc.tail = append(nwc.tail[:0], b[len(b)-recordbatch.FooterBytes:]...)
+	} else {
+		nwc.tail = append(nwc.tail, b...)
+		if len(nwc.tail) > recordbatch.FooterBytes {
+			nwc.tail = append(nwc.tail[:0], nwc.tail[len(nwc.tail)-recordbatch.FooterBytes:]...)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (nwc *nullWriteCloser) Close() error {
+	header, err := recordbatch.ParseHeader(&nwc.header)
+	if err != nil {
+		return fmt.Errorf("parsing record batch header: %w", err)
+	}
+
+	if header.Flags&recordbatch.FlagIndexFooter != 0 {
+		if len(nwc.tail) < recordbatch.FooterBytes {
+			return fmt.Errorf("record batch footer missing: %w", recordbatch.ErrBadFormat)
+		}
+		header.NumRecords = binary.LittleEndian.Uint32(nwc.tail[0:4])
+		header.RecordsSize = binary.LittleEndian.Uint32(nwc.tail[4:8])
+	}
+
+	return nwc.store(header)
+}
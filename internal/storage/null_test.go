@@ -0,0 +1,150 @@
+package storage_test
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNullStorageWriteRead verifies that records added to a Storage backed by
+// NullStorage are read back as zero bytes of the expected total size, also
+// after reopening the topic.
+func TestNullStorageWriteRead(t *testing.T) {
+	ns := &storage.NullStorage{}
+	s, err := storage.NewStorage(log, ns, "", "mytopic")
+	require.NoError(t, err)
+
+	recordBatch := [][]byte{[]byte("abc"), []byte("de"), []byte("fgh")}
+
+	// Test
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	// Verify
+	s, err = storage.NewStorage(log, ns, "", "mytopic")
+	require.NoError(t, err)
+
+	for recordID := uint64(3); recordID < 6; recordID++ {
+		got, err := s.ReadRecord(recordID)
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, len(got)), got)
+	}
+
+	totalSize := 0
+	for recordID := uint64(0); recordID < 3; recordID++ {
+		got, err := s.ReadRecord(recordID)
+		require.NoError(t, err)
+		totalSize += len(got)
+	}
+	require.Equal(t, 8, totalSize)
+
+	_, err = s.ReadRecord(6)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+}
+
+// TestNullStorageKeepsHeader verifies that record batches read from
+// NullStorage have the header they were written with, and that reading a
+// record batch that doesn't exist returns os.ErrNotExist.
+func TestNullStorageKeepsHeader(t *testing.T) {
+	ns := &storage.NullStorage{}
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	defaultUnixEpochUs := recordbatch.UnixEpochUs
+	defer func() {
+		recordbatch.UnixEpochUs = defaultUnixEpochUs
+	}()
+	recordbatch.UnixEpochUs = func() int64 {
+		return createdAt.UnixMicro()
+	}
+
+	wtr, err := ns.Writer("mytopic/1.record_batch")
+	require.NoError(t, err)
+	require.NoError(t, recordbatch.WriteAligned(wtr, [][]byte{[]byte("abc")}))
+	require.NoError(t, wtr.Close())
+
+	recordbatch.UnixEpochUs = defaultUnixEpochUs
+
+	// Test
+	rdr, err := ns.Reader("mytopic/1.record_batch")
+	require.NoError(t, err)
+	rb, err := recordbatch.Parse(rdr)
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, createdAt.UnixMicro(), rb.Header.UnixEpochUs)
+	require.Equal(t, recordbatch.FlagAligned, rb.Header.Flags)
+
+	_, err = ns.Reader("mytopic/2.record_batch")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// TestNullStorageIndexFooter verifies that record batches written by
+// recordbatch.Writer are read back from NullStorage with the same number of
+// records, records size and header.
+func TestNullStorageIndexFooter(t *testing.T) {
+	ns := &storage.NullStorage{}
+
+	records := [][]byte{[]byte("a"), []byte("bcd"), {}, []byte("efgh")}
+
+	wtr, err := ns.Writer("mytopic/1.record_batch")
+	require.NoError(t, err)
+
+	// write in small chunks, such that the footer spans several writes
+	rbWriter := recordbatch.NewWriter(&chunkedWriter{wtr: wtr, chunkSize: 3})
+	for _, record := range records {
+		require.NoError(t, rbWriter.Append(record))
+	}
+	require.NoError(t, rbWriter.Close())
+	require.NoError(t, wtr.Close())
+
+	// Test
+	rdr, err := ns.Reader("mytopic/1.record_batch")
+	require.NoError(t, err)
+	rb, err := recordbatch.Parse(rdr)
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, recordbatch.FlagIndexFooter, rb.Header.Flags)
+	require.EqualValues(t, len(records), rb.Header.NumRecords)
+	require.EqualValues(t, 8, rb.Header.RecordsSize)
+
+	recordsSize := 0
+	for i := range records {
+		record, err := rb.Record(uint32(i))
+		require.NoError(t, err)
+		recordsSize += len(record)
+	}
+	require.Equal(t, 8, recordsSize)
+}
+
+// chunkedWriter writes to wtr in chunks of at most chunkSize bytes.
+type chunkedWriter struct {
+	wtr       io.Writer
+	chunkSize int
+}
+
+func (cw *chunkedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > cw.chunkSize {
+			n = cw.chunkSize
+		}
+
+		n, err := cw.wtr.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
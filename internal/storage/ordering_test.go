@@ -0,0 +1,317 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// The ordering contract of Storage:
+//   - record IDs are assigned consecutively, starting at 0
+//   - the first record ID of a record batch equals the number of records
+//     that existed before it was added, also across restarts
+//   - records are read back in record ID order, across record batch
+//     boundaries
+//   - records added in a single call keep their order and get consecutive
+//     record IDs
+//
+// The tests below verify the contract against all BackingStorages.
+
+// orderingBackends returns functions that open a Storage on top of a
+// BackingStorage. Calling a function multiple times opens the same topic,
+// simulating a restart.
+func orderingBackends(t *testing.T) map[string]func() *storage.Storage {
+	diskDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	memoryStorage := &storage.MemoryStorage{}
+
+	s3CacheDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+	s3Mock := newS3MemoryMock()
+
+	return map[string]func() *storage.Storage{
+		"disk": func() *storage.Storage {
+			s, err := storage.NewDiskStorage(log, diskDir, "mytopic")
+			require.NoError(t, err)
+			return s
+		},
+		"memory": func() *storage.Storage {
+			s, err := storage.NewStorage(log, memoryStorage, "/", "mytopic")
+			require.NoError(t, err)
+			return s
+		},
+		"s3": func() *storage.Storage {
+			s, err := storage.NewS3Storage(log, storage.S3StorageInput{
+				S3:             s3Mock,
+				LocalCacheRoot: s3CacheDir,
+				BucketName:     "mybucket",
+				RootDir:        "root",
+				Topic:          "mytopic",
+			})
+			require.NoError(t, err)
+			return s
+		},
+	}
+}
+
+// TestStorageOrderingSequential verifies the ordering contract when record
+// batches are added sequentially, and that it holds across restarts.
+func TestStorageOrderingSequential(t *testing.T) {
+	for name, openStorage := range orderingBackends(t) {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			checker := newOrderingChecker()
+
+			for restart := 0; restart < 3; restart++ {
+				s := openStorage()
+
+				for i := 0; i < 5; i++ {
+					recordBatch := tester.MakeRandomRecordBatch(1 + i)
+
+					// Test
+					recordIDs, err := s.AddRecordBatch(recordBatch)
+					require.NoError(t, err)
+
+					require.NoError(t, checker.added(recordBatch, recordIDs))
+				}
+
+				// Verify
+				checker.verify(t, s)
+			}
+		})
+	}
+}
+
+// TestStorageOrderingConcurrent verifies the ordering contract when records
+// are added concurrently through a BlockingBatcher, and that each producer
+// observes increasing record IDs for its own sequential adds.
+func TestStorageOrderingConcurrent(t *testing.T) {
+	const (
+		producers         = 8
+		addsPerProducer   = 20
+		maxRecordsPerCall = 4
+	)
+
+	for name, openStorage := range orderingBackends(t) {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			s := openStorage()
+			checker := newOrderingChecker()
+
+			// require must only be used from the test goroutine; errors from
+			// persist and the producers are collected and checked after
+			// wg.Wait()
+			errsMu := sync.Mutex{}
+			errs := []error{}
+			addErr := func(err error) {
+				errsMu.Lock()
+				defer errsMu.Unlock()
+				errs = append(errs, err)
+			}
+
+			nextBatchID := uint64(0)
+			persist := func(records [][]byte) ([]uint64, error) {
+				recordIDs, err := s.AddRecordBatch(records)
+				if err == nil {
+					// the batch must start where the previous one ended
+					if recordIDs[0] != nextBatchID {
+						addErr(fmt.Errorf("batch starts at record ID %d, expected %d", recordIDs[0], nextBatchID))
+					}
+					nextBatchID += uint64(len(recordIDs))
+				}
+				return recordIDs, err
+			}
+
+			makeContext := func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond, cancel)
+				return ctx
+			}
+			batcher := recordbatch.NewBlockingBatcher(log, makeContext, persist)
+
+			wg := sync.WaitGroup{}
+			wg.Add(producers)
+			for p := 0; p < producers; p++ {
+				p := p
+				go func() {
+					defer wg.Done()
+
+					var lastRecordID uint64
+					for i := 0; i < addsPerProducer; i++ {
+						records := tester.MakeRandomRecordBatch(1 + (p+i)%maxRecordsPerCall)
+
+						// Test
+						recordIDs, err := batcher.AddRecords(records)
+						if err != nil {
+							addErr(err)
+							return
+						}
+
+						if i > 0 && recordIDs[0] <= lastRecordID {
+							addErr(fmt.Errorf("producer %d got record ID %d after %d", p, recordIDs[0], lastRecordID))
+						}
+						lastRecordID = recordIDs[len(recordIDs)-1]
+
+						err = checker.added(records, recordIDs)
+						if err != nil {
+							addErr(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			batcher.Close()
+
+			// Verify
+			for _, err := range errs {
+				require.NoError(t, err)
+			}
+			checker.verify(t, s)
+			checker.verify(t, openStorage())
+		})
+	}
+}
+
+// orderingChecker records the record IDs returned when adding records and
+// verifies that a Storage adheres to the ordering contract.
+type orderingChecker struct {
+	mu      sync.Mutex
+	records map[uint64][]byte
+}
+
+func newOrderingChecker() *orderingChecker {
+	return &orderingChecker{records: map[uint64][]byte{}}
+}
+
+// added records the record IDs returned when adding records. It returns an
+// error instead of failing the test, so that it can be called from goroutines
+// other than the test goroutine.
+func (oc *orderingChecker) added(records [][]byte, recordIDs []uint64) error {
+	if len(records) != len(recordIDs) {
+		return fmt.Errorf("got %d record IDs for %d records", len(recordIDs), len(records))
+	}
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	for i, recordID := range recordIDs {
+		if i > 0 && recordID != recordIDs[i-1]+1 {
+			return fmt.Errorf("record ID %d follows %d", recordID, recordIDs[i-1])
+		}
+
+		if _, exists := oc.records[recordID]; exists {
+			return fmt.Errorf("record ID %d assigned twice", recordID)
+		}
+		oc.records[recordID] = records[i]
+	}
+
+	return nil
+}
+
+func (oc *orderingChecker) verify(t *testing.T, s *storage.Storage) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	numRecords := uint64(len(oc.records))
+
+	// record IDs are dense
+	for recordID := uint64(0); recordID < numRecords; recordID++ {
+		require.Contains(t, oc.records, recordID)
+
+		got, err := s.ReadRecord(recordID)
+		require.NoError(t, err)
+		require.Equal(t, oc.records[recordID], got)
+	}
+
+	_, err := s.ReadRecord(numRecords)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+
+	// iteration returns records in record ID order
+	it := s.Iterator(0)
+	defer it.Close()
+
+	expectedRecordID := uint64(0)
+	for it.Next() {
+		require.Equal(t, expectedRecordID, it.RecordID())
+		require.Equal(t, oc.records[expectedRecordID], it.Record())
+		expectedRecordID++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, numRecords, expectedRecordID)
+}
+
+// newS3MemoryMock returns an S3Mock that keeps objects in memory.
+func newS3MemoryMock() *storage.S3Mock {
+	mu := sync.Mutex{}
+	objects := map[string][]byte{}
+
+	s3Mock := &storage.S3Mock{}
+	s3Mock.MockPutObject = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		objects[*input.Key] = body
+		return &s3.PutObjectOutput{}, nil
+	}
+
+	s3Mock.MockGetObject = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, ok := objects[*input.Key]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+	}
+
+	s3Mock.MockDeleteObject = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delete(objects, *input.Key)
+		return &s3.DeleteObjectOutput{}, nil
+	}
+
+	s3Mock.MockListObjectPages = func(input *s3.ListObjectsInput, f func(*s3.ListObjectsOutput, bool) bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// S3 lists keys in lexicographical order
+		keys := make([]string, 0, len(objects))
+		for key := range objects {
+			if strings.HasPrefix(key, *input.Prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		output := &s3.ListObjectsOutput{}
+		for _, key := range keys {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+		}
+		f(output, true)
+		return nil
+	}
+
+	return s3Mock
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ByteRateLimiter is a token bucket limiting the rate of bytes transferred.
+// A ByteRateLimiter can be shared between S3Storages to enforce a global
+// limit, or be used by a single S3Storage to limit a single topic.
+type ByteRateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int
+	tokens         float64
+	last           time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewByteRateLimiter returns a ByteRateLimiter that allows bytesPerSecond
+// bytes per second, with bursts of up to bytesPerSecond bytes. A
+// bytesPerSecond of zero or less means unlimited.
+func NewByteRateLimiter(bytesPerSecond int) *ByteRateLimiter {
+	return &ByteRateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+// Wait blocks until n bytes may be transferred. n must not be larger than the
+// limiter's burst size, see maxChunk().
+func (l *ByteRateLimiter) Wait(n int) {
+	if l.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	wait := l.reserve(n)
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// reserve takes n tokens and returns how long to wait before they may be
+// used. Tokens may go negative, such that later callers wait for earlier
+// reservations to be paid off first.
+func (l *ByteRateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.bytesPerSecond)
+	if l.tokens > float64(l.bytesPerSecond) {
+		l.tokens = float64(l.bytesPerSecond)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(l.bytesPerSecond) * float64(time.Second))
+}
+
+func (l *ByteRateLimiter) maxChunk() int {
+	if l.bytesPerSecond <= 0 {
+		return math.MaxInt
+	}
+	return l.bytesPerSecond
+}
+
+// rateLimitBody returns a request.Option that limits the rate that the
+// request body is sent by all of the given limiters.
+//
+// NOTE: the body is limited when it is sent rather than when it is read; the
+// SDK also reads seekable bodies to compute their checksums, which must
+// neither use tokens nor be slowed down.
+func rateLimitBody(limiters []*ByteRateLimiter) request.Option {
+	return func(r *request.Request) {
+		// Send handlers run for each attempt, after the body has been reset
+		r.Handlers.Send.PushFront(func(r *request.Request) {
+			if r.HTTPRequest.Body == nil || r.HTTPRequest.Body == http.NoBody {
+				return
+			}
+			r.HTTPRequest.Body = &rateLimitedReadCloser{ReadCloser: r.HTTPRequest.Body, limiters: limiters}
+		})
+	}
+}
+
+// rateLimitedReadCloser limits the rate that bytes are read from the
+// underlying io.ReadCloser by all of the given limiters.
+type rateLimitedReadCloser struct {
+	io.ReadCloser
+	limiters []*ByteRateLimiter
+}
+
+func (r *rateLimitedReadCloser) Read(p []byte) (int, error) {
+	for _, limiter := range r.limiters {
+		if len(p) > limiter.maxChunk() {
+			p = p[:limiter.maxChunk()]
+		}
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	for _, limiter := range r.limiters {
+		limiter.Wait(n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/micvbang/go-helpy/stringy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestByteRateLimiterWait verifies that ByteRateLimiter allows an initial
+// burst and then limits to the configured rate.
+func TestByteRateLimiterWait(t *testing.T) {
+	now := time.Now()
+	slept := time.Duration(0)
+
+	limiter := NewByteRateLimiter(1000)
+	limiter.last = now
+	limiter.now = func() time.Time {
+		return now
+	}
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// Test, Verify
+	limiter.Wait(1000)
+	require.Equal(t, time.Duration(0), slept)
+
+	limiter.Wait(500)
+	require.Equal(t, 500*time.Millisecond, slept)
+
+	// tokens refill over time
+	now = now.Add(time.Second)
+	limiter.Wait(1000)
+	require.Equal(t, 500*time.Millisecond, slept)
+}
+
+// TestByteRateLimiterUnlimited verifies that a ByteRateLimiter with a rate of
+// zero or less doesn't limit, and that reads through it make progress.
+func TestByteRateLimiterUnlimited(t *testing.T) {
+	for _, bytesPerSecond := range []int{0, -1} {
+		limiter := NewByteRateLimiter(bytesPerSecond)
+		limiter.sleep = func(d time.Duration) {
+			t.Fatalf("unexpected sleep of %s", d)
+		}
+
+		data := []byte(stringy.RandomN(100))
+		rdr := &rateLimitedReadCloser{ReadCloser: io.NopCloser(bytes.NewReader(data)), limiters: []*ByteRateLimiter{limiter}}
+
+		// Test
+		got, err := io.ReadAll(rdr)
+
+		// Verify
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+}
+
+// TestByteRateLimiterSleepsWithoutLock verifies that a waiter sleeping in
+// Wait() doesn't prevent other waiters from reserving bytes.
+func TestByteRateLimiterSleepsWithoutLock(t *testing.T) {
+	sleeping := make(chan time.Duration, 2)
+	release := make(chan struct{})
+
+	limiter := NewByteRateLimiter(1000)
+	limiter.sleep = func(d time.Duration) {
+		sleeping <- d
+		<-release
+	}
+	defer close(release)
+
+	limiter.Wait(1000)
+
+	// Test
+	for i := 0; i < 2; i++ {
+		go limiter.Wait(500)
+	}
+
+	// Verify
+	waits := []time.Duration{}
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-sleeping:
+			waits = append(waits, d)
+		case <-time.After(time.Second):
+			t.Fatal("Wait() blocked by sleeping waiter")
+		}
+	}
+
+	// the second waiter waits for the first one's reservation
+	require.InDelta(t, 1500*time.Millisecond, waits[0]+waits[1], float64(50*time.Millisecond))
+}
+
+// TestS3UploadRateLimited verifies that uploads to S3 are rate limited by all
+// of the configured limiters, and that only the bytes sent to S3 are limited.
+// A real S3 client is used since it also reads the body to compute checksums.
+func TestS3UploadRateLimited(t *testing.T) {
+	recordBatchBody := []byte(stringy.RandomN(1500))
+
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		gotBody, err = io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("eu-west-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	require.NoError(t, err)
+
+	// the body is read by the HTTP transport's goroutine
+	mu := sync.Mutex{}
+	now := time.Now()
+	slept := time.Duration(0)
+	makeLimiter := func(bytesPerSecond int) *ByteRateLimiter {
+		limiter := NewByteRateLimiter(bytesPerSecond)
+		limiter.last = now
+		limiter.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		limiter.sleep = func(d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			slept += d
+			now = now.Add(d)
+		}
+		return limiter
+	}
+
+	s3Storage := &S3Storage{
+		log:            log,
+		s3:             s3.New(sess),
+		topicCacheRoot: t.TempDir(),
+		bucketName:     "mybucket",
+		uploadLimiters: []*ByteRateLimiter{makeLimiter(1_000_000), makeLimiter(1000)},
+	}
+
+	rbWriter, err := s3Storage.Writer("topicName/000123.record_batch")
+	require.NoError(t, err)
+
+	_, err = io.Copy(rbWriter, bytes.NewReader(recordBatchBody))
+	require.NoError(t, err)
+
+	// Test
+	err = rbWriter.Close()
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, recordBatchBody, gotBody)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// 1000 bytes of burst, the remaining 500 bytes at 1000 B/s
+	require.InDelta(t, 500*time.Millisecond, slept, float64(50*time.Millisecond))
+}
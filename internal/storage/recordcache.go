@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// RecordCache is an in-memory LRU cache of records, bounded by the total size
+// of the cached records. A RecordCache can be shared between topics.
+type RecordCache struct {
+	mu        sync.Mutex
+	maxBytes  int
+	usedBytes int
+	entries   map[recordCacheKey]*list.Element
+
+	// lru contains *recordCacheEntry, most recently used at the front
+	lru *list.List
+}
+
+type recordCacheKey struct {
+	topicPath string
+	recordID  uint64
+}
+
+type recordCacheEntry struct {
+	key    recordCacheKey
+	record []byte
+}
+
+func NewRecordCache(maxBytes int) *RecordCache {
+	return &RecordCache{
+		maxBytes: maxBytes,
+		entries:  make(map[recordCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns a copy of the cached record, if it exists.
+func (rc *RecordCache) get(topicPath string, recordID uint64) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[recordCacheKey{topicPath: topicPath, recordID: recordID}]
+	if !ok {
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+
+	record := elem.Value.(*recordCacheEntry).record
+	return append([]byte{}, record...), true
+}
+
+// put adds record to the cache, evicting the least recently used records if
+// the cache is full. Records larger than the cache are not added.
+func (rc *RecordCache) put(topicPath string, recordID uint64, record []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	key := recordCacheKey{topicPath: topicPath, recordID: recordID}
+	if _, ok := rc.entries[key]; ok || len(record) > rc.maxBytes {
+		return
+	}
+
+	for rc.usedBytes+len(record) > rc.maxBytes {
+		rc.remove(rc.lru.Back())
+	}
+
+	entry := &recordCacheEntry{key: key, record: append([]byte{}, record...)}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	rc.usedBytes += len(record)
+}
+
+// remove removes elem from the cache. rc.mu must be held.
+func (rc *RecordCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*recordCacheEntry)
+	delete(rc.entries, entry.key)
+	rc.usedBytes -= len(entry.record)
+}
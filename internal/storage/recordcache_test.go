@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecordCacheEvictsLeastRecentlyUsed verifies that RecordCache evicts the
+// least recently used records when adding a record would exceed its size.
+func TestRecordCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rc := NewRecordCache(10)
+
+	rc.put("topic", 0, []byte("aaaa"))
+	rc.put("topic", 1, []byte("bbbb"))
+
+	// make record 0 most recently used
+	_, ok := rc.get("topic", 0)
+	require.True(t, ok)
+
+	// Test
+	rc.put("topic", 2, []byte("cccc"))
+
+	// Verify
+	got, ok := rc.get("topic", 0)
+	require.True(t, ok)
+	require.Equal(t, []byte("aaaa"), got)
+
+	_, ok = rc.get("topic", 1)
+	require.False(t, ok)
+
+	got, ok = rc.get("topic", 2)
+	require.True(t, ok)
+	require.Equal(t, []byte("cccc"), got)
+
+	require.Equal(t, 8, rc.usedBytes)
+}
+
+// TestRecordCacheTopics verifies that records with the same record ID from
+// different topics are cached separately.
+func TestRecordCacheTopics(t *testing.T) {
+	rc := NewRecordCache(100)
+
+	rc.put("topic1", 0, []byte("topic1"))
+	rc.put("topic2", 0, []byte("topic2"))
+
+	got, ok := rc.get("topic1", 0)
+	require.True(t, ok)
+	require.Equal(t, []byte("topic1"), got)
+
+	got, ok = rc.get("topic2", 0)
+	require.True(t, ok)
+	require.Equal(t, []byte("topic2"), got)
+}
+
+// TestRecordCacheTooLarge verifies that records larger than the cache are not
+// added, and don't evict other records.
+func TestRecordCacheTooLarge(t *testing.T) {
+	rc := NewRecordCache(10)
+	rc.put("topic", 0, []byte("small"))
+
+	// Test
+	rc.put("topic", 1, make([]byte, 11))
+
+	// Verify
+	_, ok := rc.get("topic", 1)
+	require.False(t, ok)
+
+	_, ok = rc.get("topic", 0)
+	require.True(t, ok)
+}
+
+// TestRecordCacheReturnsCopy verifies that modifying a record returned by the
+// cache doesn't modify the cached record.
+func TestRecordCacheReturnsCopy(t *testing.T) {
+	rc := NewRecordCache(10)
+	rc.put("topic", 0, []byte("record"))
+
+	got, ok := rc.get("topic", 0)
+	require.True(t, ok)
+
+	// Test
+	got[0] = 'X'
+
+	// Verify
+	got, ok = rc.get("topic", 0)
+	require.True(t, ok)
+	require.Equal(t, []byte("record"), got)
+}
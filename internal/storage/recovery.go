@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+)
+
+const quarantineExtension = ".quarantine"
+
+// initNextRecordID sets nextRecordID from the newest record batch. If the
+// newest record batch is corrupt, e.g. because it was only partially written
+// when the process crashed, it is quarantined and the previous record batch
+// is used instead. Its records are lost, but were never acknowledged.
+//
+// Only record batches that were read successfully but failed to parse are
+// considered corrupt; errors reading from the backing storage are returned.
+// Record batches are never quarantined because of a corrupt local copy, see
+// reparseRecordBatchHeader().
+func (s *Storage) initNextRecordID() error {
+	if len(s.recordBatchIDs) == 0 {
+		return nil
+	}
+
+	newestRecordBatchID := s.recordBatchIDs[len(s.recordBatchIDs)-1]
+	hdr, err := s.parseRecordBatchHeader(newestRecordBatchID)
+	if errors.Is(err, recordbatch.ErrBadFormat) {
+		hdr, err = s.reparseRecordBatchHeader(newestRecordBatchID, err)
+	}
+	if errors.Is(err, recordbatch.ErrBadFormat) {
+		s.log.Errorf("newest record batch %d is corrupt, quarantining it: %s", newestRecordBatchID, err)
+
+		err = s.quarantineRecordBatch(newestRecordBatchID)
+		if err != nil {
+			return fmt.Errorf("quarantining record batch %d: %w", newestRecordBatchID, err)
+		}
+
+		s.recordBatchIDs = s.recordBatchIDs[:len(s.recordBatchIDs)-1]
+		if len(s.recordBatchIDs) == 0 {
+			return nil
+		}
+
+		newestRecordBatchID = s.recordBatchIDs[len(s.recordBatchIDs)-1]
+		hdr, err = s.parseRecordBatchHeader(newestRecordBatchID)
+	}
+	if err != nil {
+		return fmt.Errorf("reading record batch header: %w", err)
+	}
+
+	// earlier versions persisted empty record batches, which take the ID of
+	// the next record batch
+	if hdr.NumRecords == 0 {
+		s.log.Warnf("newest record batch %d is empty, quarantining it", newestRecordBatchID)
+
+		err = s.quarantineRecordBatch(newestRecordBatchID)
+		if err != nil {
+			return fmt.Errorf("quarantining record batch %d: %w", newestRecordBatchID, err)
+		}
+		s.recordBatchIDs = s.recordBatchIDs[:len(s.recordBatchIDs)-1]
+	}
+
+	s.nextRecordID = newestRecordBatchID + uint64(hdr.NumRecords)
+	return nil
+}
+
+// parseRecordBatchHeader fully parses the record batch with the given ID,
+// verifying that its record index is consistent with its size, and returns
+// its header.
+func (s *Storage) parseRecordBatchHeader(recordBatchID uint64) (recordbatch.Header, error) {
+	rb, f, err := s.openRecordBatch(recordBatchID)
+	if err != nil {
+		return recordbatch.Header{}, err
+	}
+	defer f.Close()
+
+	return rb.Header, nil
+}
+
+// cacheEvicter is implemented by BackingStorages that keep local copies of
+// record batches stored elsewhere, e.g. S3Storage.
+type cacheEvicter interface {
+	evictCache(recordBatchPath string) error
+}
+
+// reparseRecordBatchHeader is called when parsing the record batch with the
+// given ID failed with parseErr. If the backing storage keeps a local copy of
+// the record batch, the copy may be what is corrupt, e.g. because the process
+// crashed while downloading it; it is evicted and the record batch is parsed
+// again from the backing storage. Otherwise, parseErr is returned.
+func (s *Storage) reparseRecordBatchHeader(recordBatchID uint64, parseErr error) (recordbatch.Header, error) {
+	evicter, ok := s.backingStorage.(cacheEvicter)
+	if !ok {
+		return recordbatch.Header{}, parseErr
+	}
+
+	rbPath := s.recordBatchPath(recordBatchID)
+	s.log.Warnf("record batch %d failed to parse, evicting it from the cache: %s", recordBatchID, parseErr)
+
+	err := evicter.evictCache(rbPath)
+	if err != nil {
+		return recordbatch.Header{}, fmt.Errorf("evicting '%s' from cache: %w", rbPath, err)
+	}
+
+	return s.parseRecordBatchHeader(recordBatchID)
+}
+
+// quarantineRecordBatch copies the record batch with the given ID to a file
+// that is ignored when listing record batches, and deletes the record batch
+// such that its ID can be reused.
+func (s *Storage) quarantineRecordBatch(recordBatchID uint64) error {
+	rbPath := s.recordBatchPath(recordBatchID)
+	quarantinePath := fmt.Sprintf("%s.%d%s", rbPath, time.Now().UTC().UnixMicro(), quarantineExtension)
+
+	err := s.copyFile(rbPath, quarantinePath)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the record batch must not be open when deleting it; Windows
+	// doesn't allow deleting open files
+	err = s.backingStorage.Delete(rbPath)
+	if err != nil {
+		return fmt.Errorf("deleting '%s': %w", rbPath, err)
+	}
+
+	// a new record batch with the same ID is named using the current format
+	delete(s.legacyRecordBatchIDs, recordBatchID)
+
+	return nil
+}
+
+// copyFile copies the file at srcPath to dstPath in the backing storage.
+func (s *Storage) copyFile(srcPath string, dstPath string) error {
+	rdr, err := s.backingStorage.Reader(srcPath)
+	if err != nil {
+		return fmt.Errorf("opening reader '%s': %w", srcPath, err)
+	}
+	defer rdr.Close()
+
+	wtr, err := s.backingStorage.Writer(dstPath)
+	if err != nil {
+		return fmt.Errorf("opening writer '%s': %w", dstPath, err)
+	}
+
+	_, err = io.Copy(wtr, rdr)
+	if err != nil {
+		wtr.Close()
+		return fmt.Errorf("copying to '%s': %w", dstPath, err)
+	}
+
+	err = wtr.Close()
+	if err != nil {
+		return fmt.Errorf("closing writer '%s': %w", dstPath, err)
+	}
+
+	return nil
+}
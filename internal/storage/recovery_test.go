@@ -0,0 +1,270 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewStorageQuarantinesTruncatedRecordBatch verifies that NewStorage()
+// quarantines a truncated newest record batch, continues from the previous
+// record batch, and that the truncated record batch's ID is reused.
+func TestNewStorageQuarantinesTruncatedRecordBatch(t *testing.T) {
+	backingStorage := &storage.MemoryStorage{}
+
+	s := mustNewStorage(t, backingStorage)
+	recordBatch := tester.MakeRandomRecordBatch(3)
+	_, err := s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	// partially written record batch starting at record ID 3
+	buf := bytes.NewBuffer(nil)
+	err = recordbatch.Write(buf, tester.MakeRandomRecordBatch(5))
+	require.NoError(t, err)
+	truncated := buf.Bytes()[:buf.Len()-10]
+
+	wtr, err := backingStorage.Writer("mytopic/00000000000000000003.record_batch")
+	require.NoError(t, err)
+	_, err = wtr.Write(truncated)
+	require.NoError(t, err)
+	require.NoError(t, wtr.Close())
+
+	// Test
+	s = mustNewStorage(t, backingStorage)
+
+	// Verify
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(3), high)
+
+	quarantined, err := backingStorage.ListFiles("mytopic", ".quarantine")
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+
+	got, err := s.ReadRecords(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch, got)
+
+	recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, recordIDs)
+}
+
+// TestNewStorageQuarantinesOnlyRecordBatch verifies that NewStorage()
+// returns an empty topic when its only record batch is corrupt.
+func TestNewStorageQuarantinesOnlyRecordBatch(t *testing.T) {
+	backingStorage := &storage.MemoryStorage{}
+
+	wtr, err := backingStorage.Writer("mytopic/00000000000000000000.record_batch")
+	require.NoError(t, err)
+	_, err = wtr.Write([]byte("smb"))
+	require.NoError(t, err)
+	require.NoError(t, wtr.Close())
+
+	// Test
+	s := mustNewStorage(t, backingStorage)
+
+	// Verify
+	low, high := s.Watermarks()
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(0), high)
+
+	recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, recordIDs)
+}
+
+// TestNewStorageQuarantinesEmptyRecordBatch verifies that NewStorage()
+// quarantines an empty newest record batch, as persisted by earlier versions,
+// such that records can be added to the topic.
+func TestNewStorageQuarantinesEmptyRecordBatch(t *testing.T) {
+	backingStorage := &storage.MemoryStorage{}
+
+	s := mustNewStorage(t, backingStorage)
+	_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(3))
+	require.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	err = recordbatch.Write(buf, nil)
+	require.NoError(t, err)
+
+	wtr, err := backingStorage.Writer("mytopic/00000000000000000003.record_batch")
+	require.NoError(t, err)
+	_, err = wtr.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, wtr.Close())
+
+	// Test
+	s = mustNewStorage(t, backingStorage)
+
+	// Verify
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(3), high)
+
+	recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, recordIDs)
+}
+
+// TestNewStorageS3TruncatedDownload verifies that NewStorage() doesn't
+// quarantine or delete the newest record batch when downloading it from S3
+// fails part-way, and that the partial download isn't cached.
+func TestNewStorageS3TruncatedDownload(t *testing.T) {
+	s3Mock := newS3MemoryMock()
+	openStorage := func(cacheDir string) (*storage.Storage, error) {
+		return storage.NewS3Storage(log, storage.S3StorageInput{
+			S3:             s3Mock,
+			LocalCacheRoot: cacheDir,
+			BucketName:     "mybucket",
+			RootDir:        "root",
+			Topic:          "mytopic",
+		})
+	}
+
+	s, err := openStorage(t.TempDir())
+	require.NoError(t, err)
+	recordBatch := tester.MakeRandomRecordBatch(3)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	getObject := s3Mock.MockGetObject
+	s3Mock.MockGetObject = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		output, err := getObject(input)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(output.Body)
+		require.NoError(t, err)
+
+		truncated := io.MultiReader(bytes.NewReader(body[:len(body)/2]), iotest.ErrReader(io.ErrUnexpectedEOF))
+		return &s3.GetObjectOutput{Body: io.NopCloser(truncated)}, nil
+	}
+
+	deleted := false
+	deleteObject := s3Mock.MockDeleteObject
+	s3Mock.MockDeleteObject = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		deleted = true
+		return deleteObject(input)
+	}
+
+	cacheDir := t.TempDir()
+
+	// Test
+	_, err = openStorage(cacheDir)
+
+	// Verify
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.False(t, deleted)
+
+	s3Mock.MockGetObject = getObject
+	s, err = openStorage(cacheDir)
+	require.NoError(t, err)
+
+	got, err := s.ReadRecords(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch, got)
+	require.False(t, deleted)
+}
+
+// TestNewStorageS3TruncatedCacheCopy verifies that NewStorage() doesn't
+// quarantine or delete the newest record batch from S3 when only its locally
+// cached copy is truncated, e.g. because the process crashed while
+// downloading it.
+func TestNewStorageS3TruncatedCacheCopy(t *testing.T) {
+	s3Mock := newS3MemoryMock()
+	cacheDir := t.TempDir()
+	openStorage := func() (*storage.Storage, error) {
+		return storage.NewS3Storage(log, storage.S3StorageInput{
+			S3:             s3Mock,
+			LocalCacheRoot: cacheDir,
+			BucketName:     "mybucket",
+			RootDir:        "root",
+			Topic:          "mytopic",
+		})
+	}
+
+	s, err := openStorage()
+	require.NoError(t, err)
+	recordBatch := tester.MakeRandomRecordBatch(3)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	cachePath := filepath.Join(cacheDir, "root", "mytopic", "00000000000000000000.record_batch")
+	cached, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(cachePath, cached[:len(cached)/2], 0o600))
+
+	deleted := false
+	deleteObject := s3Mock.MockDeleteObject
+	s3Mock.MockDeleteObject = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		deleted = true
+		return deleteObject(input)
+	}
+
+	// Test
+	s, err = openStorage()
+
+	// Verify
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(3), high)
+
+	got, err := s.ReadRecords(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch, got)
+}
+
+// TestNewStorageDiskQuarantinesTruncatedRecordBatch verifies that NewStorage()
+// quarantines a truncated newest record batch stored on disk.
+func TestNewStorageDiskQuarantinesTruncatedRecordBatch(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, backingStorage := range []storage.DiskStorage{{}, {Pool: storage.NewFilePool(4)}} {
+		backingStorage := backingStorage
+		rootDir := filepath.Join(tempDir, fmt.Sprintf("pool_%t", backingStorage.Pool != nil))
+
+		s, err := storage.NewStorage(log, backingStorage, rootDir, "mytopic")
+		require.NoError(t, err)
+		recordBatch := tester.MakeRandomRecordBatch(3)
+		_, err = s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+
+		buf := bytes.NewBuffer(nil)
+		err = recordbatch.Write(buf, tester.MakeRandomRecordBatch(5))
+		require.NoError(t, err)
+		rbPath := filepath.Join(rootDir, "mytopic", "00000000000000000003.record_batch")
+		require.NoError(t, os.WriteFile(rbPath, buf.Bytes()[:buf.Len()-10], 0o600))
+
+		// Test
+		s, err = storage.NewStorage(log, backingStorage, rootDir, "mytopic")
+
+		// Verify
+		require.NoError(t, err)
+
+		_, high := s.Watermarks()
+		require.Equal(t, uint64(3), high)
+		require.NoFileExists(t, rbPath)
+
+		quarantined, err := filepath.Glob(rbPath + ".*.quarantine")
+		require.NoError(t, err)
+		require.Len(t, quarantined, 1)
+
+		got, err := s.ReadRecords(0, 10)
+		require.NoError(t, err)
+		require.Equal(t, recordBatch, got)
+
+		recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{3}, recordIDs)
+	}
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micvbang/go-helpy/inty"
+)
+
+// RetentionPolicy configures which record batches of a topic are deleted by
+// EnforceRetention(). The newest record batch of a topic is never deleted,
+// such that record IDs aren't reused when the topic is reopened.
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of record batches. Zero means unlimited.
+	MaxAge time.Duration
+
+	// MaxBytes is the maximum total size of a topic's record batches. Zero
+	// means unlimited.
+	MaxBytes int64
+}
+
+// Retention returns the topic's retention policy, set by the TopicTemplate
+// that the topic was created from, see TopicManager.CreateTopics(). The
+// policy isn't enforced by the Storage itself; pass it to RunRetention() or
+// EnforceRetention().
+func (s *Storage) Retention() RetentionPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retention
+}
+
+func (s *Storage) setRetention(policy RetentionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retention = policy
+}
+
+// EnforceRetention deletes the oldest record batches that violate policy and
+// returns the number of deleted record batches. Record batch headers and
+// sizes are read without blocking other operations on the topic.
+func (s *Storage) EnforceRetention(policy RetentionPolicy) (int, error) {
+	recordBatchIDs, _ := s.recordBatchIDsSnapshot()
+
+	expired := 0
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge)
+
+		n, err := s.countRecordBatchesBefore(recordBatchIDs, cutoff)
+		if err != nil {
+			return 0, err
+		}
+		expired = n
+	}
+
+	if policy.MaxBytes > 0 {
+		n, err := s.countRecordBatchesExceeding(recordBatchIDs, policy.MaxBytes)
+		if err != nil {
+			return 0, err
+		}
+		if n > expired {
+			expired = n
+		}
+	}
+
+	if expired == 0 {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the index may have changed since it was copied; only delete record
+	// batches that were found to be expired.
+	keepFromID := recordBatchIDs[expired]
+	n := sort.Search(len(s.recordBatchIDs), func(i int) bool {
+		return s.recordBatchIDs[i] >= keepFromID
+	})
+
+	return s.deleteOldestRecordBatches(n)
+}
+
+// DeleteBefore deletes the record batches that only contain records with IDs
+// below recordID, and returns the number of deleted record batches. The
+// record batch containing recordID, and the newest record batch, are kept.
+func (s *Storage) DeleteBefore(recordID uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// index of the first record batch starting after recordID; all record
+	// batches before the one preceding it are entirely below recordID.
+	i := sort.Search(len(s.recordBatchIDs), func(i int) bool {
+		return s.recordBatchIDs[i] > recordID
+	})
+	if i == 0 {
+		return 0, nil
+	}
+
+	return s.deleteOldestRecordBatches(i - 1)
+}
+
+// RunRetention calls EnforceRetention() every interval until ctx expires.
+// Errors are logged.
+func (s *Storage) RunRetention(ctx context.Context, policy RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := s.EnforceRetention(policy)
+		if err != nil {
+			s.log.Errorf("enforcing retention: %s", err)
+		}
+		if deleted > 0 {
+			s.log.Infof("retention deleted %d record batches", deleted)
+		}
+	}
+}
+
+// countRecordBatchesBefore returns the number of consecutive record batches
+// of recordBatchIDs, starting from the oldest, that were created before
+// cutoff. The newest record batch is not counted. s.mu must not be held.
+func (s *Storage) countRecordBatchesBefore(recordBatchIDs []uint64, cutoff time.Time) (int, error) {
+	n := 0
+	for _, recordBatchID := range recordBatchIDs[:deletableRecordBatches(recordBatchIDs)] {
+		hdr, err := readRecordBatchHeader(s.backingStorage, s.recordBatchPath(recordBatchID))
+		if err != nil {
+			return 0, fmt.Errorf("reading record batch header: %w", err)
+		}
+
+		if !time.UnixMicro(hdr.UnixEpochUs).Before(cutoff) {
+			break
+		}
+		n += 1
+	}
+
+	return n, nil
+}
+
+// countRecordBatchesExceeding returns the number of oldest record batches of
+// recordBatchIDs that must be deleted for their total size to be at most
+// maxBytes. Only the sizes of the record batches that are kept, and of the
+// newest record batch that isn't, are needed. The newest record batch is not
+// counted. s.mu must not be held.
+func (s *Storage) countRecordBatchesExceeding(recordBatchIDs []uint64, maxBytes int64) (int, error) {
+	var totalBytes int64
+	for i := len(recordBatchIDs) - 1; i >= 0; i-- {
+		size, err := s.loadRecordBatchSize(recordBatchIDs[i])
+		if err != nil {
+			return 0, err
+		}
+
+		totalBytes += size
+		if totalBytes > maxBytes {
+			return inty.Min(i+1, deletableRecordBatches(recordBatchIDs)), nil
+		}
+	}
+
+	return 0, nil
+}
+
+// deletableRecordBatches returns the number of record batches of
+// recordBatchIDs that may be deleted, i.e. all but the newest.
+func deletableRecordBatches(recordBatchIDs []uint64) int {
+	if len(recordBatchIDs) == 0 {
+		return 0
+	}
+	return len(recordBatchIDs) - 1
+}
+
+// deleteOldestRecordBatches deletes the n oldest record batches, but never
+// the newest, and returns the number of deleted record batches. Record
+// batches are removed from the index as they are deleted, such that the index
+// matches the backing storage if an error occurs. s.mu must be held.
+func (s *Storage) deleteOldestRecordBatches(n int) (int, error) {
+	if n > deletableRecordBatches(s.recordBatchIDs) {
+		n = deletableRecordBatches(s.recordBatchIDs)
+	}
+
+	for deleted := 0; deleted < n; deleted++ {
+		rbPath := s.recordBatchPath(s.recordBatchIDs[0])
+		err := s.backingStorage.Delete(rbPath)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting record batch '%s': %w", rbPath, err)
+		}
+
+		delete(s.recordBatchSizes, s.recordBatchIDs[0])
+		s.recordBatchIDs = s.recordBatchIDs[1:]
+	}
+
+	return n, nil
+}
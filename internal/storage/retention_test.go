@@ -0,0 +1,230 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// addRecordBatchesWithAges adds a record batch of batchSize records for each
+// of the given ages, oldest first, with timestamps set accordingly.
+func addRecordBatchesWithAges(t *testing.T, s *storage.Storage, batchSize int, ages ...time.Duration) [][]byte {
+	defaultUnixEpochUs := recordbatch.UnixEpochUs
+	defer func() {
+		recordbatch.UnixEpochUs = defaultUnixEpochUs
+	}()
+
+	records := [][]byte{}
+	for _, age := range ages {
+		age := age
+		recordbatch.UnixEpochUs = func() int64 {
+			return time.Now().Add(-age).UnixMicro()
+		}
+
+		recordBatch := tester.MakeRandomRecordBatch(batchSize)
+		_, err := s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+		records = append(records, recordBatch...)
+	}
+
+	return records
+}
+
+// TestStorageRetentionMaxAge verifies that EnforceRetention() deletes record
+// batches older than MaxAge, that deleted records can no longer be read, and
+// that the low watermark is updated, also after reopening the topic.
+func TestStorageRetentionMaxAge(t *testing.T) {
+	for name, openStorage := range orderingBackends(t) {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			s := openStorage()
+			records := addRecordBatchesWithAges(t, s, 2, 4*time.Hour, 3*time.Hour, 2*time.Hour, time.Hour)
+
+			// Test
+			deleted, err := s.EnforceRetention(storage.RetentionPolicy{MaxAge: 150 * time.Minute})
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, 2, deleted)
+
+			for _, s := range []*storage.Storage{s, openStorage()} {
+				low, high := s.Watermarks()
+				require.Equal(t, uint64(4), low)
+				require.Equal(t, uint64(8), high)
+
+				for recordID := uint64(0); recordID < low; recordID++ {
+					_, err = s.ReadRecord(recordID)
+					require.ErrorIs(t, err, storage.ErrOutOfBounds)
+				}
+
+				got, err := s.ReadRecords(low, 10)
+				require.NoError(t, err)
+				require.Equal(t, records[low:], got)
+			}
+		})
+	}
+}
+
+// TestStorageRetentionKeepsNewest verifies that EnforceRetention() never
+// deletes the newest record batch, such that record IDs aren't reused when
+// the topic is reopened.
+func TestStorageRetentionKeepsNewest(t *testing.T) {
+	for name, openStorage := range orderingBackends(t) {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			s := openStorage()
+			addRecordBatchesWithAges(t, s, 3, 3*time.Hour, 2*time.Hour)
+
+			// Test
+			deleted, err := s.EnforceRetention(storage.RetentionPolicy{MaxAge: time.Minute})
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, 1, deleted)
+
+			s = openStorage()
+			low, high := s.Watermarks()
+			require.Equal(t, uint64(3), low)
+			require.Equal(t, uint64(6), high)
+
+			recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+			require.NoError(t, err)
+			require.Equal(t, []uint64{6}, recordIDs)
+		})
+	}
+}
+
+// TestStorageRetentionMaxBytes verifies that EnforceRetention() deletes the
+// oldest record batches until the topic's total size is at most MaxBytes,
+// both for record batches added by the Storage and for record batches that
+// existed when the topic was opened.
+func TestStorageRetentionMaxBytes(t *testing.T) {
+	// 32 bytes header + 2*4 bytes index + 2*10 bytes records
+	const recordBatchBytes = 60
+
+	for name, openStorage := range orderingBackends(t) {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			s := openStorage()
+			for i := 0; i < 4; i++ {
+				_, err := s.AddRecordBatch([][]byte{make([]byte, 10), make([]byte, 10)})
+				require.NoError(t, err)
+			}
+
+			// Test, Verify
+			deleted, err := s.EnforceRetention(storage.RetentionPolicy{MaxBytes: 3*recordBatchBytes + 1})
+			require.NoError(t, err)
+			require.Equal(t, 1, deleted)
+
+			s = openStorage()
+			deleted, err = s.EnforceRetention(storage.RetentionPolicy{MaxBytes: 2*recordBatchBytes + 1})
+			require.NoError(t, err)
+			require.Equal(t, 1, deleted)
+
+			low, high := s.Watermarks()
+			require.Equal(t, uint64(4), low)
+			require.Equal(t, uint64(8), high)
+
+			// newest record batch is kept, even when it alone exceeds MaxBytes
+			deleted, err = s.EnforceRetention(storage.RetentionPolicy{MaxBytes: 1})
+			require.NoError(t, err)
+			require.Equal(t, 1, deleted)
+
+			low, high = s.Watermarks()
+			require.Equal(t, uint64(6), low)
+			require.Equal(t, uint64(8), high)
+		})
+	}
+}
+
+// TestStorageDeleteBefore verifies that DeleteBefore() only deletes record
+// batches that are entirely below the given record ID.
+func TestStorageDeleteBefore(t *testing.T) {
+	tests := map[string]struct {
+		recordID        uint64
+		expectedDeleted int
+		expectedLow     uint64
+	}{
+		"first record":          {recordID: 0, expectedDeleted: 0, expectedLow: 0},
+		"within first batch":    {recordID: 2, expectedDeleted: 0, expectedLow: 0},
+		"start of second batch": {recordID: 3, expectedDeleted: 1, expectedLow: 3},
+		"within third batch":    {recordID: 7, expectedDeleted: 2, expectedLow: 6},
+		"beyond last record":    {recordID: 100, expectedDeleted: 2, expectedLow: 6},
+		"start of last batch":   {recordID: 6, expectedDeleted: 2, expectedLow: 6},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(3))
+				require.NoError(t, err)
+			}
+
+			// Test
+			deleted, err := s.DeleteBefore(test.recordID)
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, test.expectedDeleted, deleted)
+
+			low, high := s.Watermarks()
+			require.Equal(t, test.expectedLow, low)
+			require.Equal(t, uint64(9), high)
+		})
+	}
+}
+
+// TestStorageRetentionDoesNotBlock verifies that EnforceRetention() doesn't
+// block adding records while reading record batch headers.
+func TestStorageRetentionDoesNotBlock(t *testing.T) {
+	bs := &blockingReaderStorage{MemoryStorage: &storage.MemoryStorage{}}
+	s := mustNewStorage(t, bs)
+	addRecordBatchesWithAges(t, s, 1, 2*time.Hour, time.Hour)
+
+	// Test, Verify
+	requireAddNotBlocked(t, s, bs, func() error {
+		_, err := s.EnforceRetention(storage.RetentionPolicy{MaxAge: time.Minute})
+		return err
+	})
+
+	// only record batches that existed when retention started are deleted
+	low, high := s.Watermarks()
+	require.Equal(t, uint64(1), low)
+	require.Equal(t, uint64(3), high)
+}
+
+// TestStorageReadRecordDeletedConcurrently verifies that ReadRecord() returns
+// ErrOutOfBounds when the record's batch is deleted after the record batch
+// was looked up, but before it was read.
+func TestStorageReadRecordDeletedConcurrently(t *testing.T) {
+	bs := &blockingReaderStorage{MemoryStorage: &storage.MemoryStorage{}}
+	s := mustNewStorage(t, bs)
+	addRecordBatchesWithAges(t, s, 1, 2*time.Hour, time.Hour)
+
+	bs.block()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.ReadRecord(0)
+		errs <- err
+	}()
+	<-bs.reading
+
+	deleted, err := s.DeleteBefore(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+
+	// Test
+	bs.unblock()
+	err = <-errs
+
+	// Verify
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+}
@@ -3,11 +3,14 @@ package storage
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/micvbang/go-helpy/filey"
@@ -18,15 +21,23 @@ type S3Storage struct {
 	log            logger.Logger
 	s3             s3iface.S3API
 	topicCacheRoot string
+	cacheModes     FileModes
 	bucketName     string
+	uploadLimiters []*ByteRateLimiter
 }
 
 type S3StorageInput struct {
 	S3             s3iface.S3API
 	LocalCacheRoot string
+	CacheModes     FileModes
 	BucketName     string
 	RootDir        string
 	Topic          string
+	RecordCache    *RecordCache
+
+	// UploadLimiters limit the bandwidth used when uploading record batches
+	// to S3. Sharing a limiter between topics enforces a global limit.
+	UploadLimiters []*ByteRateLimiter
 }
 
 func NewS3Storage(log logger.Logger, input S3StorageInput) (*Storage, error) {
@@ -35,9 +46,17 @@ func NewS3Storage(log logger.Logger, input S3StorageInput) (*Storage, error) {
 		s3:             input.S3,
 		bucketName:     input.BucketName,
 		topicCacheRoot: input.LocalCacheRoot,
+		cacheModes:     input.CacheModes,
+		uploadLimiters: input.UploadLimiters,
+	}
+
+	s, err := NewStorage(log, s3Storage, input.RootDir, input.Topic)
+	if err != nil {
+		return nil, err
 	}
+	s.Cache = input.RecordCache
 
-	return NewStorage(log, s3Storage, input.RootDir, input.Topic)
+	return s, nil
 }
 
 func (ss *S3Storage) Writer(recordBatchPath string) (io.WriteCloser, error) {
@@ -49,7 +68,7 @@ func (ss *S3Storage) Writer(recordBatchPath string) (io.WriteCloser, error) {
 	log.Debugf("checking cache for record batch")
 	if filey.Exists(cacheRecordBatchPath) {
 		log.Debugf("record already exists")
-		return nil, fmt.Errorf("file already exists '%s'", cacheRecordBatchPath)
+		return nil, fmt.Errorf("'%s': %w", cacheRecordBatchPath, ErrFileExists)
 	}
 
 	log.Debugf("creating cache file")
@@ -60,11 +79,16 @@ func (ss *S3Storage) Writer(recordBatchPath string) (io.WriteCloser, error) {
 	log.Debugf("creating s3WriteCloser")
 
 	writeCloser := &s3WriteCloser{f: f, s3Upload: func(rd io.ReadSeeker) error {
-		_, err := ss.s3.PutObject(&s3.PutObjectInput{
+		opts := []request.Option{}
+		if len(ss.uploadLimiters) > 0 {
+			opts = append(opts, rateLimitBody(ss.uploadLimiters))
+		}
+
+		_, err := ss.s3.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
 			Bucket: &ss.bucketName,
 			Key:    &recordBatchPath,
 			Body:   rd,
-		})
+		}, opts...)
 		return err
 	}}
 
@@ -100,24 +124,78 @@ func (ss *S3Storage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
 	}
 	defer obj.Body.Close()
 
-	log.Debugf("creating cache file")
-	f, err = ss.createCacheFile(cacheRecordBatchPath)
+	log.Debugf("copying s3 object to cache")
+	err = ss.downloadToCache(cacheRecordBatchPath, obj)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debugf("copying s3 object to cache file")
-	_, err = io.Copy(f, obj.Body)
+	f, err = os.Open(cacheRecordBatchPath)
 	if err != nil {
-		return nil, fmt.Errorf("writing s3 object to disk '%s': %w", cacheRecordBatchPath, err)
+		return nil, fmt.Errorf("opening cached record batch '%s': %w", cacheRecordBatchPath, err)
 	}
 
-	_, err = f.Seek(0, io.SeekStart)
+	return f, nil
+}
+
+// downloadToCache writes the body of obj to a temporary file which is renamed
+// to cacheRecordBatchPath once the whole object has been written, such that
+// partial downloads, e.g. due to the process crashing, are never served from
+// the cache.
+func (ss *S3Storage) downloadToCache(cacheRecordBatchPath string, obj *s3.GetObjectOutput) error {
+	err := ss.cacheModes.mkdirAll(filepath.Dir(cacheRecordBatchPath))
 	if err != nil {
-		return nil, fmt.Errorf("seeking to beginning of file: %w", err)
+		return fmt.Errorf("creating cache topic dir: %w", err)
 	}
 
-	return f, nil
+	var f *os.File
+	var tmpPath string
+	for {
+		tmpPath = fmt.Sprintf("%s.%s%s", cacheRecordBatchPath, strconv.FormatUint(rand.Uint64(), 36), tmpExtension)
+		f, err = ss.cacheModes.createNew(tmpPath)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("creating cache file '%s': %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	n, err := io.Copy(f, obj.Body)
+	if err == nil && obj.ContentLength != nil && n != *obj.ContentLength {
+		err = fmt.Errorf("read %d of %d bytes: %w", n, *obj.ContentLength, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing s3 object to disk '%s': %w", tmpPath, err)
+	}
+
+	// NOTE: files must be closed before being renamed on Windows
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("closing cache file '%s': %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, cacheRecordBatchPath)
+	if err != nil {
+		return fmt.Errorf("renaming '%s' to '%s': %w", tmpPath, cacheRecordBatchPath, err)
+	}
+
+	return nil
+}
+
+// evictCache removes the locally cached copy of the record batch at
+// recordBatchPath, if any, such that it is read from S3 the next time it is
+// needed.
+func (ss *S3Storage) evictCache(recordBatchPath string) error {
+	cacheRecordBatchPath := ss.recordBatchCachePath(recordBatchPath)
+	err := os.Remove(cacheRecordBatchPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("deleting cached record batch '%s': %w", cacheRecordBatchPath, err)
+	}
+
+	return nil
 }
 
 func (ss *S3Storage) ListFiles(topicPath string, extension string) ([]string, error) {
@@ -129,10 +207,17 @@ func (ss *S3Storage) ListFiles(topicPath string, extension string) ([]string, er
 
 	topicPath, _ = strings.CutPrefix(topicPath, "/")
 
+	// only list the topic's own files, not those of topics that it is a
+	// prefix of
+	prefix := topicPath
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
 	log.Debugf("listing objects in s3")
 	err := ss.s3.ListObjectsPages(&s3.ListObjectsInput{
 		Bucket: aws.String(ss.bucketName),
-		Prefix: &topicPath,
+		Prefix: &prefix,
 	}, func(objects *s3.ListObjectsOutput, b bool) bool {
 		for _, obj := range objects.Contents {
 			if obj == nil || obj.Key == nil {
@@ -153,21 +238,36 @@ func (ss *S3Storage) ListFiles(topicPath string, extension string) ([]string, er
 	return fileNames, err
 }
 
+func (ss *S3Storage) Delete(recordBatchPath string) error {
+	log := ss.log.WithField("recordBatchPath", recordBatchPath)
+
+	log.Debugf("deleting object from s3")
+	_, err := ss.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucketName),
+		Key:    &recordBatchPath,
+	})
+	if err != nil {
+		return fmt.Errorf("deleting s3 object: %w", err)
+	}
+
+	return ss.evictCache(recordBatchPath)
+}
+
 func (ss *S3Storage) recordBatchCachePath(recordBatchPath string) string {
-	return filepath.Join(ss.topicCacheRoot, recordBatchPath)
+	return filepath.Join(ss.topicCacheRoot, filepath.FromSlash(recordBatchPath))
 }
 
 func (ss *S3Storage) createCacheFile(cacheRecordBatchPath string) (*os.File, error) {
 	log := ss.log.WithField("cacheRecordBatchPath", cacheRecordBatchPath)
 
 	log.Debugf("creating cache dirs")
-	err := os.MkdirAll(filepath.Dir(cacheRecordBatchPath), os.ModePerm)
+	err := ss.cacheModes.mkdirAll(filepath.Dir(cacheRecordBatchPath))
 	if err != nil {
 		return nil, fmt.Errorf("creating cache topic dir: %w", err)
 	}
 
 	log.Debugf("creating cache file")
-	f, err := os.Create(cacheRecordBatchPath)
+	f, err := ss.cacheModes.create(cacheRecordBatchPath)
 	if err != nil {
 		return nil, fmt.Errorf("creating cache record batch '%s': %w", cacheRecordBatchPath, err)
 	}
@@ -185,6 +285,19 @@ func (swc *s3WriteCloser) Write(b []byte) (int, error) {
 }
 
 func (swc *s3WriteCloser) Close() error {
+	err := swc.upload()
+	closeErr := swc.f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("closing file: %w", closeErr)
+	}
+
+	return nil
+}
+
+func (swc *s3WriteCloser) upload() error {
 	_, err := swc.f.Seek(0, io.SeekStart)
 	if err != nil {
 		return fmt.Errorf("seeking to beginning: %w", err)
@@ -195,10 +308,5 @@ func (swc *s3WriteCloser) Close() error {
 		return fmt.Errorf("uploading to s3: %w", err)
 	}
 
-	err = swc.f.Close()
-	if err != nil {
-		return fmt.Errorf("closing file: %w", err)
-	}
-
 	return nil
 }
@@ -7,6 +7,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/micvbang/go-helpy/stringy"
@@ -138,6 +140,32 @@ func TestS3ReadFromCache(t *testing.T) {
 	require.Equal(t, recordBatchBody, gotBytes)
 }
 
+// TestS3ListFilesPrefix verifies that ListFiles only lists objects within the
+// topic's own "directory", such that topics whose names are prefixes of
+// each other don't see each other's record batches.
+func TestS3ListFilesPrefix(t *testing.T) {
+	var gotPrefix string
+
+	s3Mock := &S3Mock{}
+	s3Mock.MockListObjectPages = func(input *s3.ListObjectsInput, f func(*s3.ListObjectsOutput, bool) bool) error {
+		gotPrefix = *input.Prefix
+		return nil
+	}
+
+	s3Storage := &S3Storage{
+		log:        log,
+		s3:         s3Mock,
+		bucketName: "mybucket",
+	}
+
+	// Test
+	_, err := s3Storage.ListFiles("/root/topic1", ".record_batch")
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, "root/topic1/", gotPrefix)
+}
+
 type S3Mock struct {
 	s3iface.S3API
 
@@ -149,6 +177,9 @@ type S3Mock struct {
 
 	MockListObjectPages   func(*s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool) error
 	ListObjectPagesCalled bool
+
+	MockDeleteObject   func(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	DeleteObjectCalled bool
 }
 
 func (sm *S3Mock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
@@ -156,6 +187,10 @@ func (sm *S3Mock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, erro
 	return sm.MockPutObject(input)
 }
 
+func (sm *S3Mock) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	return sm.PutObject(input)
+}
+
 func (sm *S3Mock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	sm.GetObjectCalled = true
 	return sm.MockGetObject(input)
@@ -165,3 +200,8 @@ func (sm *S3Mock) ListObjectsPages(input *s3.ListObjectsInput, f func(*s3.ListOb
 	sm.ListObjectPagesCalled = true
 	return sm.MockListObjectPages(input, f)
 }
+
+func (sm *S3Mock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	sm.DeleteObjectCalled = true
+	return sm.MockDeleteObject(input)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import "fmt"
+
+const sealedExtension = ".sealed"
+
+var (
+	// ErrTopicSealed is returned when adding records to a sealed topic.
+	ErrTopicSealed = fmt.Errorf("topic sealed")
+
+	// ErrEndOfTopic is returned when waiting for a record beyond the last
+	// record of a sealed topic.
+	ErrEndOfTopic = fmt.Errorf("end of topic")
+)
+
+// Seal seals the topic such that no further records can be added, and
+// consumers waiting for records beyond the last record are told that the
+// end of the topic has been reached. Sealing is persisted in the backing
+// storage and cannot be undone. Sealing a sealed topic is a no-op.
+func (s *Storage) Seal() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.sealed {
+		return nil
+	}
+
+	err := s.writeMarker(sealedExtension)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sealed = true
+
+	// wake up waiters
+	close(s.recordsAdded)
+	s.recordsAdded = make(chan struct{})
+
+	return nil
+}
+
+// Sealed returns whether the topic is sealed.
+func (s *Storage) Sealed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sealed
+}
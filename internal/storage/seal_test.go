@@ -0,0 +1,83 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStorageSeal verifies that records can't be added to a sealed topic,
+// that existing records can still be read, and that sealing persists across
+// restarts for all BackingStorages.
+func TestStorageSeal(t *testing.T) {
+	backends := orderingBackends(t)
+
+	nullStorage := &storage.NullStorage{}
+	backends["null"] = func() *storage.Storage {
+		s, err := storage.NewStorage(log, nullStorage, "", "mytopic")
+		require.NoError(t, err)
+		return s
+	}
+
+	for name, openStorage := range backends {
+		openStorage := openStorage
+		t.Run(name, func(t *testing.T) {
+			s := openStorage()
+
+			recordBatch := tester.MakeRandomRecordBatch(3)
+			_, err := s.AddRecordBatch(recordBatch)
+			require.NoError(t, err)
+			require.False(t, s.Sealed())
+
+			// Test
+			err = s.Seal()
+			require.NoError(t, err)
+
+			// Verify
+			for _, s := range []*storage.Storage{s, openStorage()} {
+				require.True(t, s.Sealed())
+
+				_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+				require.ErrorIs(t, err, storage.ErrTopicSealed)
+
+				// NullStorage doesn't keep the contents of records
+				got, err := s.ReadRecords(0, 10)
+				require.NoError(t, err)
+				require.Len(t, got, len(recordBatch))
+
+				// sealing is idempotent
+				require.NoError(t, s.Seal())
+			}
+		})
+	}
+}
+
+// TestStorageSealWakesWaiters verifies that WaitForRecord() returns
+// ErrEndOfTopic for records beyond the end of a sealed topic, including for
+// waiters that were blocked when the topic was sealed.
+func TestStorageSealWakesWaiters(t *testing.T) {
+	s := mustNewStorage(t, &storage.MemoryStorage{})
+
+	_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, s.Seal())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Test
+	err = s.WaitForRecord(ctx, 1)
+
+	// Verify
+	require.ErrorIs(t, err, storage.ErrEndOfTopic)
+	require.NoError(t, s.WaitForRecord(ctx, 0))
+	require.ErrorIs(t, s.WaitForRecord(ctx, 5), storage.ErrEndOfTopic)
+}
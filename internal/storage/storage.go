@@ -1,148 +1,590 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/micvbang/go-helpy/uint64y"
 	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
 	"github.com/micvbang/simple-message-broker/internal/recordbatch"
 )
 
+// ErrFileExists is returned by BackingStorages when writing a record batch
+// that already exists. Record batches are never overwritten.
+var ErrFileExists = fmt.Errorf("file already exists")
+
 type BackingStorage interface {
 	Writer(recordBatchPath string) (io.WriteCloser, error)
 	Reader(recordBatchPath string) (io.ReadSeekCloser, error)
+
+	// ListFiles returns the files of the topic at topicPath with the given
+	// extension, or all of its files if extension is empty.
 	ListFiles(topicPath string, extension string) ([]string, error)
+	Delete(recordBatchPath string) error
 }
 
 type Storage struct {
-	log            logger.Logger
-	topicPath      string
+	log       logger.Logger
+	topicPath string
+
+	// writeMu serializes writes to the backing storage, i.e. adding record
+	// batches and writing markers, such that mu is only held while updating
+	// the topic's state and not while waiting for the backing storage.
+	// nextRecordID, sealed and created are only modified while holding both
+	// writeMu and mu, so either is enough to read them.
+	writeMu sync.Mutex
+
+	mu             sync.Mutex
 	nextRecordID   uint64
 	recordBatchIDs []uint64
 
+	// recordBatchSizes caches the size in bytes of record batches, by record
+	// batch ID. Sizes of record batches that existed before the Storage was
+	// created are added when first needed.
+	recordBatchSizes map[uint64]int64
+
+	// legacyRecordBatchIDs contains the IDs of record batches named using the
+	// legacy 12-digit format. It is not modified after NewStorage() returns.
+	legacyRecordBatchIDs map[uint64]bool
+
+	// sealed is true once the topic has been sealed, see Seal().
+	sealed bool
+
+	// created is true once the topic has been created by
+	// TopicManager.Create(), see markCreated().
+	created bool
+
+	// retention is the topic's retention policy, see Retention().
+	retention RetentionPolicy
+
+	// recordsAdded is closed and replaced whenever records are added, and
+	// when the topic is sealed
+	recordsAdded chan struct{}
+
 	backingStorage BackingStorage
+
+	// Cache, if non-nil, caches records that are read. It can be shared
+	// between Storages. It must be set before the Storage is used.
+	Cache *RecordCache
+
+	// Breaker, if non-nil, freezes AddRecordBatch() after consecutive
+	// failures. It must be set before the Storage is used.
+	Breaker *Breaker
 }
 
+// NewStorage returns a Storage for topic, using backingStorage to store record
+// batches under rootDir.
+//
+// Paths given to backingStorage are always slash-separated, regardless of the
+// operating system. Backing storages that use the local file system must
+// convert them using filepath.FromSlash().
+//
+// NOTE: on case-insensitive file systems, e.g. the defaults on Windows and
+// macOS, topic names that differ only in case refer to the same topic.
 func NewStorage(log logger.Logger, backingStorage BackingStorage, rootDir string, topic string) (*Storage, error) {
-	topicPath := filepath.Join(rootDir, topic)
+	topicPath := path.Join(filepath.ToSlash(rootDir), topic)
+
+	// list all of the topic's files at once; listing is expensive for some
+	// backing storages, e.g. S3
+	filePaths, err := backingStorage.ListFiles(topicPath, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
 
-	recordBatchIDs, err := listRecordBatchIDs(backingStorage, topicPath)
+	recordBatchIDs, legacyRecordBatchIDs, err := parseRecordBatchIDs(filePaths)
 	if err != nil {
-		return nil, fmt.Errorf("listing record batches: %w", err)
+		return nil, fmt.Errorf("parsing record batch names: %w", err)
 	}
 
+	sealed := hasExtension(filePaths, sealedExtension)
+	created := hasExtension(filePaths, createdExtension)
+
 	storage := &Storage{
-		log:            log,
-		backingStorage: backingStorage,
-		topicPath:      topicPath,
-		recordBatchIDs: recordBatchIDs,
+		log:              log,
+		backingStorage:   backingStorage,
+		topicPath:        topicPath,
+		recordBatchIDs:   recordBatchIDs,
+		recordBatchSizes: make(map[uint64]int64),
+		recordsAdded:     make(chan struct{}),
+		sealed:           sealed,
+		created:          created,
+
+		legacyRecordBatchIDs: legacyRecordBatchIDs,
 	}
 
-	if len(recordBatchIDs) > 0 {
-		newestRecordBatchID := recordBatchIDs[len(recordBatchIDs)-1]
-		hdr, err := readRecordBatchHeader(backingStorage, topicPath, newestRecordBatchID)
-		if err != nil {
-			return nil, fmt.Errorf("reading record batch header: %w", err)
-		}
-		storage.nextRecordID = newestRecordBatchID + uint64(hdr.NumRecords)
+	err = storage.initNextRecordID()
+	if err != nil {
+		return nil, err
 	}
 
 	return storage, nil
 
 }
 
-func (s *Storage) AddRecordBatch(records [][]byte) error {
+// AddRecordBatch persists records as a single record batch and returns the
+// record IDs assigned to them, in the same order as records. Nothing is
+// persisted if records is empty.
+//
+// ErrTopicSealed is returned if the topic is sealed. If the Storage has a
+// Breaker that is frozen, ErrProduceFrozen is returned without attempting to
+// persist the records.
+func (s *Storage) AddRecordBatch(records [][]byte) ([]uint64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.sealed {
+		return nil, ErrTopicSealed
+	}
+
+	// an empty record batch would take nextRecordID without advancing it,
+	// such that the next record batch would fail with ErrFileExists
+	if len(records) == 0 {
+		return []uint64{}, nil
+	}
+
+	if s.Breaker == nil {
+		return s.addRecordBatch(records)
+	}
+
+	err := s.Breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	recordIDs, err := s.addRecordBatch(records)
+	s.Breaker.record(err)
+	return recordIDs, err
+}
+
+// addRecordBatch persists records as a single record batch. s.writeMu must
+// be held; s.mu must not be held.
+func (s *Storage) addRecordBatch(records [][]byte) ([]uint64, error) {
 	recordBatchID := s.nextRecordID
 
-	rbPath := recordBatchPath(s.topicPath, recordBatchID)
+	rbPath := s.recordBatchPath(recordBatchID)
 	f, err := s.backingStorage.Writer(rbPath)
 	if err != nil {
-		return fmt.Errorf("opening writer '%s': %w", rbPath, err)
+		return nil, fmt.Errorf("opening writer '%s': %w", rbPath, err)
+	}
+
+	wtr := &countingWriter{Writer: f}
+	err = recordbatch.Write(wtr, records)
+	if err != nil {
+		f.Close()
+		s.deletePartialRecordBatch(rbPath)
+		return nil, fmt.Errorf("writing record batch: %w", err)
 	}
-	defer f.Close()
 
-	err = recordbatch.Write(f, records)
+	// NOTE: some backing storages only persist the record batch on Close()
+	err = f.Close()
 	if err != nil {
-		return fmt.Errorf("writing record batch: %w", err)
+		if !errors.Is(err, ErrFileExists) {
+			s.deletePartialRecordBatch(rbPath)
+		}
+		return nil, fmt.Errorf("closing writer '%s': %w", rbPath, err)
 	}
+
+	s.mu.Lock()
 	s.recordBatchIDs = append(s.recordBatchIDs, recordBatchID)
+	s.recordBatchSizes[recordBatchID] = wtr.n
 	s.nextRecordID = recordBatchID + uint64(len(records))
 
-	return nil
+	// wake up waiters
+	close(s.recordsAdded)
+	s.recordsAdded = make(chan struct{})
+	s.mu.Unlock()
+
+	recordIDs := make([]uint64, len(records))
+	for i := range records {
+		recordIDs[i] = recordBatchID + uint64(i)
+	}
+
+	return recordIDs, nil
 }
 
 func (s *Storage) ReadRecord(recordID uint64) ([]byte, error) {
-	if recordID >= s.nextRecordID {
-		return nil, fmt.Errorf("record ID does not exist: %w", ErrOutOfBounds)
+	recordBatchID, err := s.recordBatchIDFor(recordID)
+	if err != nil {
+		return nil, err
 	}
 
-	var recordBatchID uint64
-	for i := len(s.recordBatchIDs) - 1; i >= 0; i-- {
-		curBatchID := s.recordBatchIDs[i]
-		if curBatchID <= recordID {
-			recordBatchID = curBatchID
-			break
+	if s.Cache != nil {
+		if record, ok := s.Cache.get(s.topicPath, recordID); ok {
+			return record, nil
 		}
 	}
 
-	rbPath := recordBatchPath(s.topicPath, recordBatchID)
+	rb, f, err := s.openRecordBatch(recordBatchID)
+	if err != nil {
+		return nil, s.deletedRecordError(recordID, err)
+	}
+	defer f.Close()
+
+	record, err := rb.Record(uint32(recordID - recordBatchID))
+	if err != nil {
+		return nil, fmt.Errorf("record batch '%s': %w", s.recordBatchPath(recordBatchID), err)
+	}
+
+	if s.Cache != nil {
+		s.Cache.put(s.topicPath, recordID, record)
+	}
+
+	return record, nil
+}
+
+// deletedRecordError returns ErrRecordDeleted if recordID no longer exists,
+// e.g. because its record batch was deleted by retention after it was looked
+// up, and err otherwise.
+func (s *Storage) deletedRecordError(recordID uint64, err error) error {
+	_, idErr := s.recordBatchIDFor(recordID)
+	if errors.Is(idErr, ErrRecordDeleted) {
+		return idErr
+	}
+
+	return err
+}
+
+// deletePartialRecordBatch deletes whatever was persisted of a record batch
+// that failed to be written, such that writing it can be retried.
+func (s *Storage) deletePartialRecordBatch(rbPath string) {
+	err := s.backingStorage.Delete(rbPath)
+	if err != nil {
+		s.log.Debugf("deleting partial record batch '%s': %s", rbPath, err)
+	}
+}
+
+// ReadRecords returns up to count consecutive records, starting at
+// fromRecordID. Fewer than count records are returned if the topic doesn't
+// have that many records. Each record batch is only opened and parsed once.
+// ErrOutOfBounds is returned if fromRecordID does not exist, and ErrInvalidCount
+// if count is negative.
+func (s *Storage) ReadRecords(fromRecordID uint64, count int) ([][]byte, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("%d: %w", count, ErrInvalidCount)
+	}
+
+	_, err := s.recordBatchIDFor(fromRecordID)
+	if err != nil {
+		return nil, err
+	}
+
+	it := s.Iterator(fromRecordID)
+	defer it.Close()
+
+	// don't preallocate for records that don't exist
+	_, high := s.Watermarks()
+	capacity := uint64y.Min(uint64(count), high-fromRecordID)
+
+	records := make([][]byte, 0, capacity)
+	for len(records) < count && it.Next() {
+		records = append(records, it.Record())
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	return records, nil
+}
+
+// recordBatchIDFor returns the ID of the record batch containing recordID.
+// ErrOutOfBounds is returned if recordID does not exist, and ErrRecordDeleted
+// if it precedes the oldest record batch.
+func (s *Storage) recordBatchIDFor(recordID uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if recordID >= s.nextRecordID {
+		return 0, fmt.Errorf("record ID does not exist: %w", ErrOutOfBounds)
+	}
+
+	// index of the first record batch starting after recordID
+	i := sort.Search(len(s.recordBatchIDs), func(i int) bool {
+		return s.recordBatchIDs[i] > recordID
+	})
+	if i == 0 {
+		return 0, fmt.Errorf("record ID %d precedes oldest record batch: %w", recordID, ErrRecordDeleted)
+	}
+
+	return s.recordBatchIDs[i-1], nil
+}
+
+// openRecordBatch opens and parses the record batch with the given ID. The
+// returned io.Closer must be closed when the record batch is no longer used.
+func (s *Storage) openRecordBatch(recordBatchID uint64) (*recordbatch.RecordBatch, io.Closer, error) {
+	rbPath := s.recordBatchPath(recordBatchID)
 	f, err := s.backingStorage.Reader(rbPath)
 	if err != nil {
-		return nil, fmt.Errorf("opening reader '%s': %w", rbPath, err)
+		return nil, nil, fmt.Errorf("opening reader '%s': %w", rbPath, err)
 	}
 
 	rb, err := recordbatch.Parse(f)
 	if err != nil {
-		return nil, fmt.Errorf("parsing record batch '%s': %w", rbPath, err)
+		f.Close()
+		return nil, nil, fmt.Errorf("parsing record batch '%s': %w", rbPath, err)
 	}
 
-	record, err := rb.Record(uint32(recordID - recordBatchID))
+	return rb, f, nil
+}
+
+// WaitForRecord blocks until the record with the given ID has been added or
+// ctx expires, in which case ctx.Err() is returned. If the topic is sealed
+// and the record will never be added, ErrEndOfTopic is returned.
+func (s *Storage) WaitForRecord(ctx context.Context, recordID uint64) error {
+	for {
+		s.mu.Lock()
+		if recordID < s.nextRecordID {
+			s.mu.Unlock()
+			return nil
+		}
+		if s.sealed {
+			s.mu.Unlock()
+			return fmt.Errorf("topic sealed at record ID %d: %w", s.nextRecordID, ErrEndOfTopic)
+		}
+		recordsAdded := s.recordsAdded
+		s.mu.Unlock()
+
+		select {
+		case <-recordsAdded:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Watermarks returns the ID of the oldest record available in the topic and
+// the ID that will be assigned to the next record added. Both are 0 for an
+// empty topic; consumers are lagging if their next record ID is below high.
+func (s *Storage) Watermarks() (low uint64, high uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recordBatchIDs) > 0 {
+		low = s.recordBatchIDs[0]
+	}
+
+	return low, s.nextRecordID
+}
+
+// OffsetForTimestamp returns the ID of the first record persisted at or
+// after t. If all records were persisted before t, the ID of the next record
+// to be added is returned. Record batches are assumed to be persisted in
+// chronological order; only O(log n) record batch headers are read, without
+// blocking other operations on the topic.
+func (s *Storage) OffsetForTimestamp(t time.Time) (uint64, error) {
+	recordBatchIDs, nextRecordID := s.recordBatchIDsSnapshot()
+
+	var err error
+	i := sort.Search(len(recordBatchIDs), func(i int) bool {
+		if err != nil {
+			return true
+		}
+
+		var hdr recordbatch.Header
+		hdr, err = readRecordBatchHeader(s.backingStorage, s.recordBatchPath(recordBatchIDs[i]))
+		return !time.UnixMicro(hdr.UnixEpochUs).Before(t)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("record batch '%s': %w", rbPath, err)
+		return 0, fmt.Errorf("reading record batch header: %w", err)
 	}
-	return record, nil
+
+	if i == len(recordBatchIDs) {
+		return nextRecordID, nil
+	}
+
+	return recordBatchIDs[i], nil
 }
 
-func readRecordBatchHeader(backingStorage BackingStorage, topicPath string, recordBatchID uint64) (recordbatch.Header, error) {
-	rbPath := recordBatchPath(topicPath, recordBatchID)
-	f, err := backingStorage.Reader(rbPath)
+// TopicStats describes the records stored in a topic.
+type TopicStats struct {
+	// Records is the number of available records.
+	Records uint64
+	// RecordBatches is the number of record batches.
+	RecordBatches int
+	// Bytes is the total size of all record batches.
+	Bytes int64
+	// Oldest and Newest are the times the oldest and newest available records
+	// were persisted. They are the zero value for empty topics.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Stats returns statistics about the topic. The first call may have to read
+// the size of each record batch from the backing storage; this is done
+// without blocking other operations on the topic.
+func (s *Storage) Stats() (TopicStats, error) {
+	recordBatchIDs, nextRecordID := s.recordBatchIDsSnapshot()
+
+	stats := TopicStats{RecordBatches: len(recordBatchIDs)}
+	if len(recordBatchIDs) == 0 {
+		return stats, nil
+	}
+	stats.Records = nextRecordID - recordBatchIDs[0]
+
+	for _, recordBatchID := range recordBatchIDs {
+		size, err := s.loadRecordBatchSize(recordBatchID)
+		if err != nil {
+			return TopicStats{}, err
+		}
+		stats.Bytes += size
+	}
+
+	oldest, err := readRecordBatchHeader(s.backingStorage, s.recordBatchPath(recordBatchIDs[0]))
 	if err != nil {
-		return recordbatch.Header{}, fmt.Errorf("opening recordBatch '%s': %w", rbPath, err)
+		return TopicStats{}, fmt.Errorf("reading oldest record batch header: %w", err)
 	}
+	stats.Oldest = time.UnixMicro(oldest.UnixEpochUs)
 
-	rb, err := recordbatch.Parse(f)
+	newest, err := readRecordBatchHeader(s.backingStorage, s.recordBatchPath(recordBatchIDs[len(recordBatchIDs)-1]))
 	if err != nil {
-		return recordbatch.Header{}, fmt.Errorf("parsing record batch '%s': %w", rbPath, err)
+		return TopicStats{}, fmt.Errorf("reading newest record batch header: %w", err)
 	}
+	stats.Newest = time.UnixMicro(newest.UnixEpochUs)
 
-	return rb.Header, nil
+	return stats, nil
 }
 
-func listRecordBatchIDs(backingStorage BackingStorage, topicPath string) ([]uint64, error) {
-	filePaths, err := backingStorage.ListFiles(topicPath, recordBatchExtension)
+// recordBatchIDsSnapshot returns a copy of the IDs of the topic's record
+// batches and the ID of the next record to be added, such that they can be
+// used without holding s.mu.
+func (s *Storage) recordBatchIDsSnapshot() ([]uint64, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recordBatchIDs := make([]uint64, len(s.recordBatchIDs))
+	copy(recordBatchIDs, s.recordBatchIDs)
+
+	return recordBatchIDs, s.nextRecordID
+}
+
+// loadRecordBatchSize returns the size in bytes of the record batch with the
+// given ID. If the size isn't known, it is read from the backing storage
+// without holding s.mu, and cached if the record batch still exists.
+func (s *Storage) loadRecordBatchSize(recordBatchID uint64) (int64, error) {
+	s.mu.Lock()
+	size, ok := s.recordBatchSizes[recordBatchID]
+	s.mu.Unlock()
+	if ok {
+		return size, nil
+	}
+
+	rbPath := s.recordBatchPath(recordBatchID)
+	f, err := s.backingStorage.Reader(rbPath)
 	if err != nil {
-		return nil, fmt.Errorf("listing files: %w", err)
+		return 0, fmt.Errorf("opening reader '%s': %w", rbPath, err)
+	}
+	defer f.Close()
+
+	size, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("seeking to end of '%s': %w", rbPath, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// don't cache sizes of record batches deleted in the meantime
+	i := sort.Search(len(s.recordBatchIDs), func(i int) bool {
+		return s.recordBatchIDs[i] >= recordBatchID
+	})
+	if i < len(s.recordBatchIDs) && s.recordBatchIDs[i] == recordBatchID {
+		s.recordBatchSizes[recordBatchID] = size
+	}
+
+	return size, nil
+}
+
+// readRecordBatchHeader reads only the header of the record batch at rbPath,
+// without reading its record index.
+func readRecordBatchHeader(backingStorage BackingStorage, rbPath string) (recordbatch.Header, error) {
+	f, err := backingStorage.Reader(rbPath)
+	if err != nil {
+		return recordbatch.Header{}, fmt.Errorf("opening recordBatch '%s': %w", rbPath, err)
 	}
+	defer f.Close()
+
+	header, err := recordbatch.ParseHeader(f)
+	if err != nil {
+		return recordbatch.Header{}, fmt.Errorf("parsing record batch header '%s': %w", rbPath, err)
+	}
+
+	return header, nil
+}
 
+// parseRecordBatchIDs returns the sorted IDs of the record batches in
+// filePaths, and the IDs of those named using the legacy 12-digit format.
+// Files that aren't record batches are ignored.
+func parseRecordBatchIDs(filePaths []string) ([]uint64, map[uint64]bool, error) {
 	recordIDs := make([]uint64, 0, len(filePaths))
+	legacyRecordIDs := make(map[uint64]bool)
 	for _, filePath := range filePaths {
+		if !strings.HasSuffix(filePath, recordBatchExtension) {
+			continue
+		}
+
 		fileName := path.Base(filePath)
 		recordIDStr := fileName[:len(fileName)-len(recordBatchExtension)]
 
 		recordID, err := uint64y.FromString(recordIDStr)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
+		if len(recordIDStr) == legacyRecordBatchNameDigits {
+			legacyRecordIDs[recordID] = true
+		}
 		recordIDs = append(recordIDs, recordID)
 	}
 
-	return recordIDs, nil
+	// recordBatchIDFor() requires IDs to be sorted; backing storages don't
+	// guarantee the order of listed files.
+	sort.Slice(recordIDs, func(i, j int) bool {
+		return recordIDs[i] < recordIDs[j]
+	})
+
+	return recordIDs, legacyRecordIDs, nil
+}
+
+const (
+	// recordBatchNameDigits is the number of digits in record batch names,
+	// enough for any uint64 record ID. Record batch names are zero-padded such
+	// that they sort lexicographically in record ID order.
+	recordBatchNameDigits = 20
+
+	// legacyRecordBatchNameDigits is the number of digits in the names of
+	// record batches written by earlier versions, which only support record
+	// IDs below 10^12.
+	legacyRecordBatchNameDigits = 12
+)
+
+// recordBatchPath returns the path of the record batch with the given ID.
+// Record batches are named using recordBatchNameDigits digits, unless they
+// were written by earlier versions.
+func (s *Storage) recordBatchPath(recordBatchID uint64) string {
+	digits := recordBatchNameDigits
+	if s.legacyRecordBatchIDs[recordBatchID] {
+		digits = legacyRecordBatchNameDigits
+	}
+
+	return path.Join(s.topicPath, fmt.Sprintf("%0*d%s", digits, recordBatchID, recordBatchExtension))
+}
+
+// countingWriter counts the number of bytes written to the underlying
+// io.Writer.
+type countingWriter struct {
+	io.Writer
+	n int64
 }
 
-func recordBatchPath(topicPath string, recordBatchID uint64) string {
-	return filepath.Join(topicPath, fmt.Sprintf("%012d%s", recordBatchID, recordBatchExtension))
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.Writer.Write(b)
+	cw.n += int64(n)
+	return n, err
 }
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+// BenchmarkRecordBatchIDFor measures looking up the record batch of a record
+// in topics with many record batches.
+func BenchmarkRecordBatchIDFor(b *testing.B) {
+	for _, numBatches := range []int{1_000, 100_000} {
+		const batchSize = 10
+
+		s := &Storage{
+			recordBatchIDs: make([]uint64, numBatches),
+			nextRecordID:   uint64(numBatches * batchSize),
+		}
+		for i := range s.recordBatchIDs {
+			s.recordBatchIDs[i] = uint64(i * batchSize)
+		}
+
+		lookups := []struct {
+			name     string
+			recordID uint64
+		}{
+			{name: "oldest", recordID: 0},
+			{name: "middle", recordID: s.nextRecordID / 2},
+			{name: "newest", recordID: s.nextRecordID - 1},
+		}
+		for _, lookup := range lookups {
+			lookup := lookup
+			b.Run(fmt.Sprintf("%d batches/%s", numBatches, lookup.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := s.recordBatchIDFor(lookup.recordID)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -2,11 +2,19 @@ package storage_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/micvbang/go-helpy/inty"
 	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+	"github.com/micvbang/simple-message-broker/internal/recordbatch"
 	"github.com/micvbang/simple-message-broker/internal/storage"
 	"github.com/micvbang/simple-message-broker/internal/tester"
 	"github.com/stretchr/testify/require"
@@ -43,7 +51,7 @@ func TestStorageWriteRecordBatchSingleBatch(t *testing.T) {
 	recordBatch := tester.MakeRandomRecordBatch(5)
 
 	// Test
-	err = s.AddRecordBatch(recordBatch)
+	_, err = s.AddRecordBatch(recordBatch)
 	require.NoError(t, err)
 
 	// Verify
@@ -76,13 +84,16 @@ func TestStorageWriteRecordBatchMultipleBatches(t *testing.T) {
 	recordBatch2 := tester.MakeRandomRecordBatch(3)
 
 	// Test
-	err = s.AddRecordBatch(recordBatch1)
+	recordIDs1, err := s.AddRecordBatch(recordBatch1)
 	require.NoError(t, err)
 
-	err = s.AddRecordBatch(recordBatch2)
+	recordIDs2, err := s.AddRecordBatch(recordBatch2)
 	require.NoError(t, err)
 
 	// Verify
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, recordIDs1)
+	require.Equal(t, []uint64{5, 6, 7}, recordIDs2)
+
 	for recordID, record := range append(recordBatch1, recordBatch2...) {
 		got, err := s.ReadRecord(uint64(recordID))
 		require.NoError(t, err)
@@ -115,7 +126,7 @@ func TestStorageOpenExistingStorage(t *testing.T) {
 		require.NoError(t, err)
 
 		for _, recordBatch := range recordBatches {
-			err = s1.AddRecordBatch(recordBatch)
+			_, err = s1.AddRecordBatch(recordBatch)
 			require.NoError(t, err)
 		}
 	}
@@ -157,7 +168,7 @@ func TestStorageOpenExistingStorageAndAppend(t *testing.T) {
 		s1, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, topicName)
 		require.NoError(t, err)
 
-		err = s1.AddRecordBatch(recordBatch1)
+		_, err = s1.AddRecordBatch(recordBatch1)
 		require.NoError(t, err)
 	}
 
@@ -166,7 +177,7 @@ func TestStorageOpenExistingStorageAndAppend(t *testing.T) {
 
 	// Test
 	recordBatch2 := tester.MakeRandomRecordBatch(1)
-	err = s2.AddRecordBatch(recordBatch2)
+	_, err = s2.AddRecordBatch(recordBatch2)
 	require.NoError(t, err)
 
 	// Verify
@@ -184,3 +195,685 @@ func TestStorageOpenExistingStorageAndAppend(t *testing.T) {
 	_, err = s2.ReadRecord(uint64(len(allRecords)))
 	require.ErrorIs(t, err, storage.ErrOutOfBounds)
 }
+
+// TestStorageWaitForRecord verifies that WaitForRecord() blocks until the
+// requested record has been added, and returns immediately for records that
+// already exist.
+func TestStorageWaitForRecord(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// existing record
+	err = s.WaitForRecord(context.Background(), 0)
+	require.NoError(t, err)
+
+	recordBatch := tester.MakeRandomRecordBatch(2)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := s.AddRecordBatch(recordBatch[:1])
+		require.NoError(t, err)
+
+		time.Sleep(10 * time.Millisecond)
+		_, err = s.AddRecordBatch(recordBatch[1:])
+		require.NoError(t, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Test
+	err = s.WaitForRecord(ctx, 2)
+
+	// Verify
+	require.NoError(t, err)
+
+	got, err := s.ReadRecord(2)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch[1], got)
+}
+
+// TestStorageWaitForRecordTimeout verifies that WaitForRecord() returns the
+// context's error when it expires before the record is added.
+func TestStorageWaitForRecordTimeout(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Test
+	err = s.WaitForRecord(ctx, 0)
+
+	// Verify
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// TestStorageEmptyRecords verifies that zero-length records can be read back
+// as empty records regardless of their position in a record batch, and that
+// they don't affect the records around them.
+func TestStorageEmptyRecords(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	recordBatches := [][][]byte{
+		{{}, []byte("second"), {}, []byte("fourth"), {}},
+		{{}},
+		{[]byte("seventh")},
+	}
+
+	// Test
+	for _, recordBatch := range recordBatches {
+		_, err = s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+	}
+
+	// Verify
+	recordID := 0
+	for _, recordBatch := range recordBatches {
+		for _, record := range recordBatch {
+			got, err := s.ReadRecord(uint64(recordID))
+			require.NoError(t, err)
+			require.Equal(t, len(record), len(got))
+			require.Equal(t, string(record), string(got))
+
+			recordID += 1
+		}
+	}
+
+	_, err = s.ReadRecord(uint64(recordID))
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+}
+
+// TestStorageAddEmptyRecordBatch verifies that adding an empty record batch
+// doesn't persist anything, and doesn't prevent adding records afterwards,
+// also after reopening the topic.
+func TestStorageAddEmptyRecordBatch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	for _, records := range [][][]byte{nil, {}} {
+		// Test
+		recordIDs, err := s.AddRecordBatch(records)
+
+		// Verify
+		require.NoError(t, err)
+		require.Empty(t, recordIDs)
+	}
+
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(0), high)
+
+	recordIDs, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(2))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, recordIDs)
+
+	s, err = storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	recordIDs, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, recordIDs)
+}
+
+// TestNewStorageListsOnce verifies that NewStorage() only lists the files of
+// the topic once, and finds both record batches and markers.
+func TestNewStorageListsOnce(t *testing.T) {
+	bs := &countingListStorage{MemoryStorage: &storage.MemoryStorage{}}
+
+	s := mustNewStorage(t, bs)
+	_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(2))
+	require.NoError(t, err)
+	require.NoError(t, s.Seal())
+	lists := bs.lists
+
+	// Test
+	s = mustNewStorage(t, bs)
+
+	// Verify
+	require.Equal(t, lists+1, bs.lists)
+	require.True(t, s.Sealed())
+
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(2), high)
+}
+
+// TestStorageSlashSeparatedPaths verifies that paths given to the backing
+// storage are slash-separated, such that they are valid S3 keys on all
+// operating systems.
+func TestStorageSlashSeparatedPaths(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+
+	s, err := storage.NewStorage(log, ms, filepath.Join("some", "root"), "mytopic")
+	require.NoError(t, err)
+
+	// Test
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// Verify
+	got, err := ms.ListFiles("some/root/mytopic", ".record_batch")
+	require.NoError(t, err)
+	require.Equal(t, []string{"some/root/mytopic/00000000000000000000.record_batch"}, got)
+}
+
+// TestStorageDiskFilePool verifies that Storage can read records when
+// DiskStorage keeps fewer files open than there are record batches.
+func TestStorageDiskFilePool(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	pool := storage.NewFilePool(2)
+	defer pool.Close()
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{Pool: pool}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	records := [][]byte{}
+	for i := 0; i < 5; i++ {
+		recordBatch := tester.MakeRandomRecordBatch(3)
+		records = append(records, recordBatch...)
+
+		_, err = s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+	}
+
+	// Test, Verify
+	for round := 0; round < 2; round++ {
+		for recordID, record := range records {
+			got, err := s.ReadRecord(uint64(recordID))
+			require.NoError(t, err)
+			require.Equal(t, record, got)
+		}
+	}
+}
+
+// TestStorageRecordCache verifies that records that have been read once are
+// served from the RecordCache, without accessing the backing storage.
+func TestStorageRecordCache(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+	s.Cache = storage.NewRecordCache(1024)
+
+	recordBatch := tester.MakeRandomRecordBatch(2)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	got, err := s.ReadRecord(0)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch[0], got)
+
+	// remove record batch from backing storage
+	err = os.RemoveAll(tempDir)
+	require.NoError(t, err)
+
+	// Test
+	got, err = s.ReadRecord(0)
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, recordBatch[0], got)
+
+	// record 1 was never read and isn't cached
+	_, err = s.ReadRecord(1)
+	require.Error(t, err)
+}
+
+// TestStorageWatermarks verifies that Watermarks() returns the oldest record
+// ID and the next record ID, also after reopening the topic.
+func TestStorageWatermarks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	low, high := s.Watermarks()
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(0), high)
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(3))
+	require.NoError(t, err)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(2))
+	require.NoError(t, err)
+
+	// Test
+	low, high = s.Watermarks()
+
+	// Verify
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(5), high)
+
+	s, err = storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	low, high = s.Watermarks()
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(5), high)
+}
+
+// TestStorageReadRecords verifies that ReadRecords() returns consecutive
+// records across record batch boundaries, returns fewer records when reaching
+// the end of the topic, and returns ErrOutOfBounds for non-existing records.
+func TestStorageReadRecords(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s, err := storage.NewStorage(log, storage.DiskStorage{}, tempDir, "mytopic")
+	require.NoError(t, err)
+
+	records := [][]byte{}
+	for _, batchSize := range []int{3, 1, 5} {
+		recordBatch := tester.MakeRandomRecordBatch(batchSize)
+		records = append(records, recordBatch...)
+
+		_, err = s.AddRecordBatch(recordBatch)
+		require.NoError(t, err)
+	}
+
+	tests := map[string]struct {
+		from     uint64
+		count    int
+		expected [][]byte
+	}{
+		"first batch":    {from: 0, count: 2, expected: records[0:2]},
+		"across batches": {from: 2, count: 5, expected: records[2:7]},
+		"beyond end":     {from: 6, count: 10, expected: records[6:]},
+		"zero count":     {from: 1, count: 0, expected: [][]byte{}},
+		"huge count":     {from: 7, count: math.MaxInt, expected: records[7:]},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Test
+			got, err := s.ReadRecords(test.from, test.count)
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, test.expected, got)
+		})
+	}
+
+	_, err = s.ReadRecords(uint64(len(records)), 1)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+
+	_, err = s.ReadRecords(0, -1)
+	require.ErrorIs(t, err, storage.ErrInvalidCount)
+}
+
+// TestStorageRetryAfterFailedWrite verifies that a record batch that failed
+// to be persisted is cleaned up, such that adding records can be retried.
+func TestStorageRetryAfterFailedWrite(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "smb_*")
+	require.NoError(t, err)
+
+	s3Mock := newS3MemoryMock()
+	putObject := s3Mock.MockPutObject
+	s3Mock.MockPutObject = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return nil, fmt.Errorf("upload failed")
+	}
+
+	s, err := storage.NewS3Storage(log, storage.S3StorageInput{
+		S3:             s3Mock,
+		LocalCacheRoot: tempDir,
+		BucketName:     "mybucket",
+		Topic:          "mytopic",
+	})
+	require.NoError(t, err)
+
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.Error(t, err)
+
+	s3Mock.MockPutObject = putObject
+	recordBatch := tester.MakeRandomRecordBatch(2)
+
+	// Test
+	recordIDs, err := s.AddRecordBatch(recordBatch)
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, recordIDs)
+
+	got, err := s.ReadRecords(0, 2)
+	require.NoError(t, err)
+	require.Equal(t, recordBatch, got)
+}
+
+// TestStorageLegacyRecordBatchNames verifies that record batches named using
+// the legacy 12-digit format can be read, and that new record batches are
+// named using 20 digits.
+func TestStorageLegacyRecordBatchNames(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+
+	legacyRecordBatch := tester.MakeRandomRecordBatch(3)
+	wtr, err := ms.Writer("mytopic/000000000000.record_batch")
+	require.NoError(t, err)
+	require.NoError(t, recordbatch.Write(wtr, legacyRecordBatch))
+	require.NoError(t, wtr.Close())
+
+	s, err := storage.NewStorage(log, ms, "", "mytopic")
+	require.NoError(t, err)
+
+	// Test
+	recordBatch := tester.MakeRandomRecordBatch(2)
+	_, err = s.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	// Verify
+	files, err := ms.ListFiles("mytopic", ".record_batch")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"mytopic/000000000000.record_batch",
+		"mytopic/00000000000000000003.record_batch",
+	}, files)
+
+	s, err = storage.NewStorage(log, ms, "", "mytopic")
+	require.NoError(t, err)
+
+	got, err := s.ReadRecords(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, append(legacyRecordBatch, recordBatch...), got)
+}
+
+// TestStorageStats verifies that Stats() returns the number of records and
+// record batches, their total size, and the times of the oldest and newest
+// records, also after reopening the topic.
+func TestStorageStats(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+	s, err := storage.NewStorage(log, ms, "", "mytopic")
+	require.NoError(t, err)
+
+	stats, err := s.Stats()
+	require.NoError(t, err)
+	require.Equal(t, storage.TopicStats{}, stats)
+
+	oldest := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newest := oldest.Add(time.Hour)
+
+	defaultUnixEpochUs := recordbatch.UnixEpochUs
+	defer func() {
+		recordbatch.UnixEpochUs = defaultUnixEpochUs
+	}()
+
+	for _, createdAt := range []time.Time{oldest, oldest.Add(time.Minute), newest} {
+		createdAt := createdAt
+		recordbatch.UnixEpochUs = func() int64 {
+			return createdAt.UnixMicro()
+		}
+
+		// 32 bytes header + 2*4 bytes index + 2*10 bytes records
+		_, err = s.AddRecordBatch([][]byte{make([]byte, 10), make([]byte, 10)})
+		require.NoError(t, err)
+	}
+
+	expected := storage.TopicStats{
+		Records:       6,
+		RecordBatches: 3,
+		Bytes:         3 * 60,
+		Oldest:        oldest,
+		Newest:        newest,
+	}
+
+	// Test, Verify
+	for _, s := range []*storage.Storage{s, mustNewStorage(t, ms)} {
+		stats, err = s.Stats()
+		require.NoError(t, err)
+		require.Equal(t, expected.Records, stats.Records)
+		require.Equal(t, expected.RecordBatches, stats.RecordBatches)
+		require.Equal(t, expected.Bytes, stats.Bytes)
+		require.True(t, expected.Oldest.Equal(stats.Oldest))
+		require.True(t, expected.Newest.Equal(stats.Newest))
+	}
+}
+
+func mustNewStorage(t *testing.T, backingStorage storage.BackingStorage) *storage.Storage {
+	s, err := storage.NewStorage(log, backingStorage, "", "mytopic")
+	require.NoError(t, err)
+	return s
+}
+
+// TestStorageStatsDoesNotBlock verifies that Stats() doesn't block adding
+// records while reading from the backing storage.
+func TestStorageStatsDoesNotBlock(t *testing.T) {
+	bs := &blockingReaderStorage{MemoryStorage: &storage.MemoryStorage{}}
+	s := mustNewStorage(t, bs)
+
+	_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// Test, Verify
+	requireAddNotBlocked(t, s, bs, func() error {
+		_, err := s.Stats()
+		return err
+	})
+}
+
+// TestStorageOffsetForTimestampDoesNotBlock verifies that
+// OffsetForTimestamp() doesn't block adding records while reading from the
+// backing storage.
+func TestStorageOffsetForTimestampDoesNotBlock(t *testing.T) {
+	bs := &blockingReaderStorage{MemoryStorage: &storage.MemoryStorage{}}
+	s := mustNewStorage(t, bs)
+
+	_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	// Test, Verify
+	requireAddNotBlocked(t, s, bs, func() error {
+		_, err := s.OffsetForTimestamp(time.Now())
+		return err
+	})
+}
+
+// blockingReaderStorage is a MemoryStorage whose Reader() blocks after
+// block() has been called, until unblock() is called. It must only be
+// blocked once.
+type blockingReaderStorage struct {
+	*storage.MemoryStorage
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingReaderStorage) block() {
+	bs.reading = make(chan struct{}, 1)
+	bs.release = make(chan struct{})
+}
+
+func (bs *blockingReaderStorage) unblock() {
+	close(bs.release)
+}
+
+func (bs *blockingReaderStorage) Reader(recordBatchPath string) (io.ReadSeekCloser, error) {
+	if bs.release != nil {
+		select {
+		case bs.reading <- struct{}{}:
+		default:
+		}
+		<-bs.release
+	}
+	return bs.MemoryStorage.Reader(recordBatchPath)
+}
+
+// requireAddNotBlocked calls f, which is expected to read from bs, and
+// verifies that records can be added to s while f is blocked reading.
+func requireAddNotBlocked(t *testing.T, s *storage.Storage, bs *blockingReaderStorage, f func() error) {
+	bs.block()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f()
+	}()
+	<-bs.reading
+
+	added := make(chan error, 1)
+	go func() {
+		_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+		added <- err
+	}()
+
+	select {
+	case err := <-added:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		bs.unblock()
+		t.Fatal("adding records blocked by read from backing storage")
+	}
+
+	bs.unblock()
+	require.NoError(t, <-errs)
+}
+
+// TestStorageAddRecordBatchDoesNotBlockReads verifies that reading records
+// isn't blocked while a record batch is being written to the backing storage.
+func TestStorageAddRecordBatchDoesNotBlockReads(t *testing.T) {
+	bs := &blockingWriterStorage{
+		MemoryStorage: &storage.MemoryStorage{},
+		writing:       make(chan struct{}, 1),
+		release:       make(chan struct{}),
+	}
+	s := mustNewStorage(t, bs)
+
+	bs.blocked = true
+	added := make(chan error, 1)
+	go func() {
+		_, err := s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+		added <- err
+	}()
+	<-bs.writing
+
+	// Test
+	read := make(chan error, 1)
+	go func() {
+		_, err := s.ReadRecord(0)
+		if !errors.Is(err, storage.ErrOutOfBounds) {
+			read <- fmt.Errorf("expected ErrOutOfBounds, got %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		err = s.WaitForRecord(ctx, 0)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			read <- fmt.Errorf("expected context.DeadlineExceeded, got %v", err)
+			return
+		}
+
+		s.Watermarks()
+		s.Sealed()
+		read <- nil
+	}()
+
+	// Verify
+	select {
+	case err := <-read:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		close(bs.release)
+		t.Fatal("reading blocked by write to backing storage")
+	}
+
+	close(bs.release)
+	require.NoError(t, <-added)
+
+	_, err := s.ReadRecord(0)
+	require.NoError(t, err)
+}
+
+// blockingWriterStorage is a MemoryStorage whose writers block on Close()
+// while blocked is true, until release is closed.
+type blockingWriterStorage struct {
+	*storage.MemoryStorage
+	blocked bool
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingWriterStorage) Writer(recordBatchPath string) (io.WriteCloser, error) {
+	wtr, err := bs.MemoryStorage.Writer(recordBatchPath)
+	if err != nil || !bs.blocked {
+		return wtr, err
+	}
+
+	return &blockingWriteCloser{WriteCloser: wtr, bs: bs}, nil
+}
+
+type blockingWriteCloser struct {
+	io.WriteCloser
+	bs *blockingWriterStorage
+}
+
+func (bwc *blockingWriteCloser) Close() error {
+	bwc.bs.writing <- struct{}{}
+	<-bwc.bs.release
+	return bwc.WriteCloser.Close()
+}
+
+// TestStorageOffsetForTimestamp verifies that OffsetForTimestamp() returns
+// the ID of the first record persisted at or after the given time.
+func TestStorageOffsetForTimestamp(t *testing.T) {
+	s, err := storage.NewMemoryStorage(log, "mytopic", 0)
+	require.NoError(t, err)
+
+	got, err := s.OffsetForTimestamp(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), got)
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	defaultUnixEpochUs := recordbatch.UnixEpochUs
+	defer func() {
+		recordbatch.UnixEpochUs = defaultUnixEpochUs
+	}()
+
+	// record batches starting at record IDs 0, 3, 6, 9, persisted at t0,
+	// t0+1h, t0+2h, t0+3h
+	for i := 0; i < 4; i++ {
+		createdAt := t0.Add(time.Duration(i) * time.Hour)
+		recordbatch.UnixEpochUs = func() int64 {
+			return createdAt.UnixMicro()
+		}
+
+		_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(3))
+		require.NoError(t, err)
+	}
+
+	tests := map[string]struct {
+		t        time.Time
+		expected uint64
+	}{
+		"before first":  {t: t0.Add(-time.Hour), expected: 0},
+		"exactly first": {t: t0, expected: 0},
+		"between":       {t: t0.Add(90 * time.Minute), expected: 6},
+		"exactly last":  {t: t0.Add(3 * time.Hour), expected: 9},
+		"after last":    {t: t0.Add(4 * time.Hour), expected: 12},
+		"after first":   {t: t0.Add(time.Microsecond), expected: 3},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			// Test
+			got, err := s.OffsetForTimestamp(test.t)
+
+			// Verify
+			require.NoError(t, err)
+			require.Equal(t, test.expected, got)
+		})
+	}
+}
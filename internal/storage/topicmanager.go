@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/infrastructure/logger"
+)
+
+var (
+	// ErrInvalidTopic is returned when a topic name can't be used as a path
+	// component.
+	ErrInvalidTopic = fmt.Errorf("invalid topic name")
+
+	// ErrTopicManagerClosed is returned by TopicManager.Get() after Close()
+	// has been called.
+	ErrTopicManagerClosed = fmt.Errorf("topic manager closed")
+
+	// ErrTopicNotFound is returned by TopicManager.Get() for unknown topics
+	// when RejectUnknownTopics is set.
+	ErrTopicNotFound = fmt.Errorf("topic not found")
+)
+
+// TopicManager owns the Storages of all topics stored under the same root
+// directory of a BackingStorage. Storages are created on first use and share
+// the BackingStorage and RecordCache given to NewTopicManager().
+type TopicManager struct {
+	// RejectUnknownTopics makes Get() return ErrTopicNotFound for topics that
+	// have no records and haven't been created by Create(), by this or any
+	// other TopicManager, instead of creating them. Rejections are remembered
+	// for unknownTopicTTL, so topics created by other TopicManagers may be
+	// rejected for up to that long. Must be set before calling Get().
+	RejectUnknownTopics bool
+
+	log            logger.Logger
+	backingStorage BackingStorage
+	rootDir        string
+	cache          *RecordCache
+
+	mu     sync.Mutex
+	topics map[string]*topicEntry
+	closed bool
+
+	// unknownTopics caches when Get() rejected topics, such that repeated
+	// lookups within unknownTopicTTL don't hit the backing storage.
+	unknownTopics map[string]time.Time
+
+	now func() time.Time
+}
+
+const (
+	// maxUnknownTopics bounds the number of rejected topics that are cached.
+	maxUnknownTopics = 1024
+
+	// unknownTopicTTL is how long rejected topics are cached.
+	unknownTopicTTL = 5 * time.Second
+)
+
+// topicEntry is the Storage of a topic, or a placeholder for one that is
+// being created. s and err are set before loaded is closed.
+type topicEntry struct {
+	loaded chan struct{}
+	s      *Storage
+	err    error
+}
+
+func NewTopicManager(log logger.Logger, backingStorage BackingStorage, rootDir string, cache *RecordCache) *TopicManager {
+	return &TopicManager{
+		log:            log,
+		backingStorage: backingStorage,
+		rootDir:        rootDir,
+		cache:          cache,
+		topics:         make(map[string]*topicEntry),
+		unknownTopics:  make(map[string]time.Time),
+		now:            time.Now,
+	}
+}
+
+// Get returns the Storage for topic, creating it if it hasn't been used
+// before, see RejectUnknownTopics.
+func (tm *TopicManager) Get(topic string) (*Storage, error) {
+	return tm.get(topic, !tm.RejectUnknownTopics)
+}
+
+// Create returns the Storage for topic, creating it regardless of
+// RejectUnknownTopics. The topic is persisted in the backing storage, such
+// that it is known to other TopicManagers even before records are added.
+func (tm *TopicManager) Create(topic string) (*Storage, error) {
+	s, err := tm.get(topic, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.markCreated()
+	if err != nil {
+		return nil, fmt.Errorf("persisting topic '%s': %w", topic, err)
+	}
+
+	return s, nil
+}
+
+// get returns the Storage for topic. Storages are created without holding
+// tm.mu, such that reading a topic from the backing storage doesn't block
+// the use of other topics; concurrent calls for the same topic wait for the
+// first one.
+func (tm *TopicManager) get(topic string, create bool) (*Storage, error) {
+	err := validateTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tm.mu.Lock()
+		if tm.closed {
+			tm.mu.Unlock()
+			return nil, ErrTopicManagerClosed
+		}
+
+		if e, ok := tm.topics[topic]; ok {
+			tm.mu.Unlock()
+
+			<-e.loaded
+			if create && errors.Is(e.err, ErrTopicNotFound) {
+				// rejected by a call that didn't create the topic; retry
+				continue
+			}
+			return e.s, e.err
+		}
+
+		if rejectedAt, ok := tm.unknownTopics[topic]; ok {
+			if !create && tm.now().Sub(rejectedAt) < unknownTopicTTL {
+				tm.mu.Unlock()
+				return nil, fmt.Errorf("'%s': %w", topic, ErrTopicNotFound)
+			}
+
+			// the topic may have been created since it was rejected; load it
+			// again
+			delete(tm.unknownTopics, topic)
+		}
+
+		e := &topicEntry{loaded: make(chan struct{})}
+		tm.topics[topic] = e
+		tm.mu.Unlock()
+
+		return tm.load(topic, e, create)
+	}
+}
+
+// load creates the Storage for topic and publishes it in e.
+func (tm *TopicManager) load(topic string, e *topicEntry, create bool) (*Storage, error) {
+	s, err := NewStorage(tm.log.WithField("topic", topic), tm.backingStorage, tm.rootDir, topic)
+	if err == nil {
+		s.Cache = tm.cache
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	defer close(e.loaded)
+
+	switch {
+	case err != nil:
+		e.err = fmt.Errorf("creating storage for topic '%s': %w", topic, err)
+	case !create && !topicExists(s):
+		e.err = fmt.Errorf("'%s': %w", topic, ErrTopicNotFound)
+		if !tm.closed {
+			if len(tm.unknownTopics) >= maxUnknownTopics {
+				tm.unknownTopics = make(map[string]time.Time)
+			}
+			tm.unknownTopics[topic] = tm.now()
+		}
+	case tm.closed:
+		e.err = ErrTopicManagerClosed
+	default:
+		e.s = s
+		return s, nil
+	}
+
+	if tm.topics[topic] == e {
+		delete(tm.topics, topic)
+	}
+	return nil, e.err
+}
+
+// createdExtension is the extension of the marker persisting that a topic
+// was created by Create().
+const createdExtension = ".created"
+
+// markCreated persists that the topic was created by TopicManager.Create().
+func (s *Storage) markCreated() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.created {
+		return nil
+	}
+
+	err := s.writeMarker(createdExtension)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.created = true
+
+	return nil
+}
+
+// topicExists returns whether the topic of s has records or was created by
+// Create().
+func topicExists(s *Storage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextRecordID > 0 || s.created
+}
+
+// TopicTemplate is a preset of settings for topics created by
+// CreateTopics().
+//
+// NOTE: templates aren't persisted; topics loaded after a restart, or by
+// other TopicManagers, have the default settings.
+type TopicTemplate struct {
+	// Retention is the retention policy of created topics, see
+	// Storage.Retention().
+	Retention RetentionPolicy
+}
+
+// CreateTopics creates each of topics like Create(), applies template to
+// them, and returns the names of those that didn't already exist, i.e. that
+// were neither in use, had records, nor were created before. Creating topics
+// is idempotent, also across restarts; existing topics are left as they are.
+// All topic names are validated before any topic is created.
+//
+// If dryRun is true, no topics are created, but the names of those that
+// would have been created are returned.
+func (tm *TopicManager) CreateTopics(topics []string, template TopicTemplate, dryRun bool) ([]string, error) {
+	for _, topic := range topics {
+		err := validateTopic(topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	created := make([]string, 0, len(topics))
+	seen := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if seen[topic] {
+			continue
+		}
+		seen[topic] = true
+
+		exists, err := tm.exists(topic)
+		if err != nil {
+			return created, err
+		}
+
+		if !dryRun {
+			s, err := tm.Create(topic)
+			if err != nil {
+				return created, err
+			}
+			if !exists {
+				s.setRetention(template.Retention)
+			}
+		}
+
+		if !exists {
+			created = append(created, topic)
+		}
+	}
+
+	return created, nil
+}
+
+// exists returns whether topic is in use, has records, or was created by
+// Create(), without creating its Storage.
+func (tm *TopicManager) exists(topic string) (bool, error) {
+	tm.mu.Lock()
+	e, ok := tm.topics[topic]
+	closed := tm.closed
+	tm.mu.Unlock()
+
+	if closed {
+		return false, ErrTopicManagerClosed
+	}
+	if ok {
+		<-e.loaded
+		if e.err == nil {
+			return true, nil
+		}
+	}
+
+	topicPath := path.Join(filepath.ToSlash(tm.rootDir), topic)
+	filePaths, err := tm.backingStorage.ListFiles(topicPath, "")
+	if err != nil {
+		return false, fmt.Errorf("listing files of topic '%s': %w", topic, err)
+	}
+
+	return hasExtension(filePaths, recordBatchExtension) || hasExtension(filePaths, createdExtension), nil
+}
+
+// List returns the names of the topics that have been returned by Get() or
+// Create(), sorted alphabetically.
+func (tm *TopicManager) List() []string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	topics := make([]string, 0, len(tm.topics))
+	for topic, e := range tm.topics {
+		select {
+		case <-e.loaded:
+			if e.err == nil {
+				topics = append(topics, topic)
+			}
+		default:
+		}
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+// Close releases all Storages. Calls to Get() after Close() return
+// ErrTopicManagerClosed.
+func (tm *TopicManager) Close() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.closed = true
+	tm.topics = make(map[string]*topicEntry)
+	tm.unknownTopics = make(map[string]time.Time)
+}
+
+func validateTopic(topic string) error {
+	if topic == "" || topic == "." || topic == ".." || strings.ContainsAny(topic, `/\`) {
+		return fmt.Errorf("'%s': %w", topic, ErrInvalidTopic)
+	}
+
+	return nil
+}
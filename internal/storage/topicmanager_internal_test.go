@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTopicManagerUnknownTopicTTL verifies that a topic rejected by one
+// TopicManager can be used once it has been created by another
+// TopicManager and the rejection has expired, and that creating a rejected
+// topic continues from the records added by the other TopicManager.
+func TestTopicManagerUnknownTopicTTL(t *testing.T) {
+	bs := &MemoryStorage{}
+
+	now := time.Now()
+	tm1 := NewTopicManager(log, bs, "root", nil)
+	tm1.RejectUnknownTopics = true
+	tm1.now = func() time.Time {
+		return now
+	}
+	tm2 := NewTopicManager(log, bs, "root", nil)
+
+	_, err := tm1.Get("topic1")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+	_, err = tm1.Get("topic2")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	for _, topic := range []string{"topic1", "topic2"} {
+		s, err := tm2.Create(topic)
+		require.NoError(t, err)
+		_, err = s.AddRecordBatch([][]byte{[]byte("record")})
+		require.NoError(t, err)
+	}
+
+	// Test, Verify
+	_, err = tm1.Get("topic1")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	s, err := tm1.Create("topic2")
+	require.NoError(t, err)
+	recordIDs, err := s.AddRecordBatch([][]byte{[]byte("record")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, recordIDs)
+
+	now = now.Add(unknownTopicTTL)
+	s, err = tm1.Get("topic1")
+	require.NoError(t, err)
+
+	_, high := s.Watermarks()
+	require.Equal(t, uint64(1), high)
+}
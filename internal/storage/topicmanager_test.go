@@ -0,0 +1,294 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micvbang/simple-message-broker/internal/storage"
+	"github.com/micvbang/simple-message-broker/internal/tester"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTopicManagerGet verifies that Get() returns the same Storage for the
+// same topic, separate Storages for different topics, and that topics share
+// the backing storage.
+func TestTopicManagerGet(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+	tm := storage.NewTopicManager(log, ms, "root", nil)
+
+	// Test
+	s1, err := tm.Get("topic1")
+	require.NoError(t, err)
+
+	s2, err := tm.Get("topic2")
+	require.NoError(t, err)
+
+	s1Again, err := tm.Get("topic1")
+	require.NoError(t, err)
+
+	// Verify
+	require.Same(t, s1, s1Again)
+	require.NotSame(t, s1, s2)
+	require.Equal(t, []string{"topic1", "topic2"}, tm.List())
+
+	recordBatch := tester.MakeRandomRecordBatch(2)
+	_, err = s1.AddRecordBatch(recordBatch)
+	require.NoError(t, err)
+
+	_, err = s2.ReadRecord(0)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+
+	files, err := ms.ListFiles("root/topic1", ".record_batch")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+// TestTopicManagerInvalidTopic verifies that Get() returns ErrInvalidTopic
+// for topic names that can't be used as a path component.
+func TestTopicManagerInvalidTopic(t *testing.T) {
+	tm := storage.NewTopicManager(log, &storage.MemoryStorage{}, "root", nil)
+
+	for _, topic := range []string{"", ".", "..", "a/b", `a\b`} {
+		// Test
+		_, err := tm.Get(topic)
+
+		// Verify
+		require.ErrorIs(t, err, storage.ErrInvalidTopic)
+	}
+	require.Empty(t, tm.List())
+}
+
+// TestTopicManagerClose verifies that Get() returns ErrTopicManagerClosed
+// after Close() has been called.
+func TestTopicManagerClose(t *testing.T) {
+	tm := storage.NewTopicManager(log, &storage.MemoryStorage{}, "root", nil)
+
+	_, err := tm.Get("topic1")
+	require.NoError(t, err)
+
+	// Test
+	tm.Close()
+
+	// Verify
+	_, err = tm.Get("topic1")
+	require.ErrorIs(t, err, storage.ErrTopicManagerClosed)
+	require.Empty(t, tm.List())
+}
+
+// TestTopicManagerPrefixTopics verifies that topics whose names are prefixes
+// of each other don't see each other's record batches.
+func TestTopicManagerPrefixTopics(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+	tm := storage.NewTopicManager(log, ms, "root", nil)
+
+	s10, err := tm.Get("topic10")
+	require.NoError(t, err)
+
+	_, err = s10.AddRecordBatch(tester.MakeRandomRecordBatch(3))
+	require.NoError(t, err)
+
+	// Test
+	s1, err := storage.NewTopicManager(log, ms, "root", nil).Get("topic1")
+	require.NoError(t, err)
+
+	// Verify
+	_, err = s1.ReadRecord(0)
+	require.ErrorIs(t, err, storage.ErrOutOfBounds)
+}
+
+// TestTopicManagerRejectUnknownTopics verifies that Get() returns
+// ErrTopicNotFound for topics without records when RejectUnknownTopics is
+// set, unless they were created by Create(), also by another TopicManager.
+func TestTopicManagerRejectUnknownTopics(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+
+	s, err := storage.NewTopicManager(log, ms, "root", nil).Get("existing")
+	require.NoError(t, err)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	tm := storage.NewTopicManager(log, ms, "root", nil)
+	tm.RejectUnknownTopics = true
+
+	// Test, Verify
+	_, err = tm.Get("unknown")
+	require.ErrorIs(t, err, storage.ErrTopicNotFound)
+
+	_, err = tm.Get("existing")
+	require.NoError(t, err)
+
+	created, err := tm.Create("created")
+	require.NoError(t, err)
+
+	got, err := tm.Get("created")
+	require.NoError(t, err)
+	require.Same(t, created, got)
+
+	require.Equal(t, []string{"created", "existing"}, tm.List())
+
+	// created topics are known after a restart
+	tm = storage.NewTopicManager(log, ms, "root", nil)
+	tm.RejectUnknownTopics = true
+
+	_, err = tm.Get("created")
+	require.NoError(t, err)
+}
+
+// TestTopicManagerCreateTopics verifies that CreateTopics() creates only
+// topics that don't exist, is idempotent, also across restarts, and creates
+// nothing in dry-run mode.
+func TestTopicManagerCreateTopics(t *testing.T) {
+	ms := &storage.MemoryStorage{}
+
+	s, err := storage.NewTopicManager(log, ms, "root", nil).Get("existing")
+	require.NoError(t, err)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	tm := storage.NewTopicManager(log, ms, "root", nil)
+	topics := []string{"customer1", "existing", "customer2", "customer1"}
+
+	// Test, Verify
+	created, err := tm.CreateTopics(topics, storage.TopicTemplate{}, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"customer1", "customer2"}, created)
+	require.Empty(t, tm.List())
+
+	created, err = tm.CreateTopics(topics, storage.TopicTemplate{}, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"customer1", "customer2"}, created)
+	require.Equal(t, []string{"customer1", "customer2", "existing"}, tm.List())
+
+	created, err = tm.CreateTopics(topics, storage.TopicTemplate{}, false)
+	require.NoError(t, err)
+	require.Empty(t, created)
+
+	// created topics are known after a restart
+	tm = storage.NewTopicManager(log, ms, "root", nil)
+	created, err = tm.CreateTopics(topics, storage.TopicTemplate{}, true)
+	require.NoError(t, err)
+	require.Empty(t, created)
+}
+
+// TestTopicManagerCreateTopicsTemplate verifies that CreateTopics() applies
+// the given template to the topics it creates, but not to existing topics.
+func TestTopicManagerCreateTopicsTemplate(t *testing.T) {
+	tm := storage.NewTopicManager(log, &storage.MemoryStorage{}, "root", nil)
+
+	existing, err := tm.Create("existing")
+	require.NoError(t, err)
+
+	template := storage.TopicTemplate{
+		Retention: storage.RetentionPolicy{MaxAge: time.Hour, MaxBytes: 1024},
+	}
+
+	// Test
+	created, err := tm.CreateTopics([]string{"customer1", "existing"}, template, false)
+
+	// Verify
+	require.NoError(t, err)
+	require.Equal(t, []string{"customer1"}, created)
+
+	s, err := tm.Get("customer1")
+	require.NoError(t, err)
+	require.Equal(t, template.Retention, s.Retention())
+	require.Equal(t, storage.RetentionPolicy{}, existing.Retention())
+}
+
+// TestTopicManagerCreateTopicsInvalidTopic verifies that CreateTopics()
+// creates no topics if any topic name is invalid.
+func TestTopicManagerCreateTopicsInvalidTopic(t *testing.T) {
+	tm := storage.NewTopicManager(log, &storage.MemoryStorage{}, "root", nil)
+
+	// Test
+	_, err := tm.CreateTopics([]string{"valid", "in/valid"}, storage.TopicTemplate{}, false)
+
+	// Verify
+	require.ErrorIs(t, err, storage.ErrInvalidTopic)
+	require.Empty(t, tm.List())
+}
+
+// TestTopicManagerGetDoesNotBlockOtherTopics verifies that Get() returns
+// topics that are in use while another topic is being read from the backing
+// storage.
+func TestTopicManagerGetDoesNotBlockOtherTopics(t *testing.T) {
+	bs := &blockingReaderStorage{MemoryStorage: &storage.MemoryStorage{}}
+
+	s, err := storage.NewTopicManager(log, bs, "root", nil).Get("slow")
+	require.NoError(t, err)
+	_, err = s.AddRecordBatch(tester.MakeRandomRecordBatch(1))
+	require.NoError(t, err)
+
+	tm := storage.NewTopicManager(log, bs, "root", nil)
+	fast, err := tm.Get("fast")
+	require.NoError(t, err)
+
+	bs.block()
+	slowErrs := make(chan error, 1)
+	go func() {
+		_, err := tm.Get("slow")
+		slowErrs <- err
+	}()
+	<-bs.reading
+
+	// Test
+	got := make(chan *storage.Storage, 1)
+	go func() {
+		s, err := tm.Get("fast")
+		if err == nil {
+			got <- s
+		}
+	}()
+
+	// Verify
+	select {
+	case s := <-got:
+		require.Same(t, fast, s)
+	case <-time.After(time.Second):
+		bs.unblock()
+		t.Fatal("Get() blocked by another topic being read")
+	}
+
+	bs.unblock()
+	require.NoError(t, <-slowErrs)
+}
+
+// TestTopicManagerCachesUnknownTopics verifies that repeatedly getting an
+// unknown topic with RejectUnknownTopics set only lists its files once, and
+// that it can still be created.
+func TestTopicManagerCachesUnknownTopics(t *testing.T) {
+	bs := &countingListStorage{MemoryStorage: &storage.MemoryStorage{}}
+	tm := storage.NewTopicManager(log, bs, "root", nil)
+	tm.RejectUnknownTopics = true
+
+	_, err := tm.Get("unknown")
+	require.ErrorIs(t, err, storage.ErrTopicNotFound)
+	lists := bs.lists
+
+	// Test
+	for i := 0; i < 5; i++ {
+		_, err = tm.Get("unknown")
+		require.ErrorIs(t, err, storage.ErrTopicNotFound)
+	}
+
+	// Verify
+	require.Equal(t, lists, bs.lists)
+
+	s, err := tm.Create("unknown")
+	require.NoError(t, err)
+
+	got, err := tm.Get("unknown")
+	require.NoError(t, err)
+	require.Same(t, s, got)
+}
+
+// countingListStorage is a MemoryStorage that counts calls to ListFiles().
+type countingListStorage struct {
+	*storage.MemoryStorage
+	lists int
+}
+
+func (cs *countingListStorage) ListFiles(topicPath string, extension string) ([]string, error) {
+	cs.lists++
+	return cs.MemoryStorage.ListFiles(topicPath, extension)
+}